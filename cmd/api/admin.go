@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/able8/greenlight/internal/jsonlog"
+	"github.com/able8/greenlight/internal/validator"
+)
+
+// The requireMetricsAccess() middleware protects the read-only debug and metrics
+// endpoints, depending on the -admin-auth setting. With "none" they are open to
+// anyone who can reach them.
+func (app *application) requireMetricsAccess(next http.HandlerFunc) http.HandlerFunc {
+	switch app.config.admin.auth {
+	case "basic":
+		return app.requireBasicAuth(next)
+	case "permission":
+		return app.requirePermission("metrics:read", next)
+	default:
+		return next
+	}
+}
+
+// The requireAdminWrite() middleware protects the debug endpoints which change the
+// state of the server. These always need either the admin basic auth credentials or
+// the "admin:write" permission.
+func (app *application) requireAdminWrite(next http.HandlerFunc) http.HandlerFunc {
+	if app.config.admin.auth == "basic" {
+		return app.requireBasicAuth(next)
+	}
+	return app.requirePermission("admin:write", next)
+}
+
+// The requireBasicAuth() middleware checks the request credentials against the admin
+// username and password. We compare them in constant time to avoid leaking how much
+// of the credentials were correct through the response time.
+func (app *application) requireBasicAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(app.config.admin.username)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(app.config.admin.password)) == 1
+
+		if !usernameMatch || !passwordMatch {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// For the "/debug/pprof/*item" endpoints on the admin listener. The index and the
+// named profiles (like "heap" and "goroutine") are all served by pprof.Index().
+func (app *application) pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+// For the "GET /debug/log-level" endpoint.
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"level": app.logger.Level().String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// For the "PUT /debug/log-level" endpoint. The change takes effect immediately for
+// all log entries, but is not persisted, so the -log-level flag applies again when
+// the server is restarted.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	level, err := jsonlog.ParseLevel(input.Level)
+	v.Check(err == nil, "level", "must be one of debug, info, warn, error, fatal or off")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+	app.logger.SetLevel(level)
+
+	// Log the change at the WARN level, so that it is still written if the new level
+	// is above INFO.
+	app.logger.PrintWarn("log level changed", jsonlog.Properties{
+		"from":       previous.String(),
+		"to":         level.String(),
+		"request_id": app.contextGetRequestID(r),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"level": level.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -15,9 +15,30 @@ type contextKey string
 // setting user information in the request context.
 const userContextKey = contextKey("user")
 
+// The requestIDContextKey constant is the key for the ID of the current request.
+const requestIDContextKey = contextKey("request_id")
+
+// The requestInfoContextKey constant is the key for the requestInfo of the current request.
+const requestInfoContextKey = contextKey("request_info")
+
+// requestInfo holds details about a request which are only known deep inside the
+// middleware chain, like the matched route pattern and the authenticated user. A
+// pointer to it is added to the context by the outermost middleware, so that the
+// details can be filled in by inner handlers and read by outer middleware (like the
+// access log) once the request has been handled.
+type requestInfo struct {
+	route  string
+	userID int64
+}
+
 // The contextSetUser() method returns a new copy of the request with the provided User struct added to the context.
 // Note that we use our userContextKey constant as the key.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	// Also record the user ID in the requestInfo, so that it can be logged.
+	if info := app.contextGetRequestInfo(r); info != nil {
+		info.userID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -33,3 +54,31 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetRequestID() method returns a new copy of the request with the provided
+// request ID added to the context.
+func (app *application) contextSetRequestID(r *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() method returns the ID of the current request, or the
+// empty string if no request ID has been set in the context.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// The contextSetRequestInfo() method returns a new copy of the request with the
+// provided requestInfo added to the context.
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestInfo() method returns the requestInfo for the current request,
+// or nil if there isn't one.
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
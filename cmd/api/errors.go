@@ -2,12 +2,18 @@ package main
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/able8/greenlight/internal/jsonlog"
 )
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, "edit_conflict", message)
 }
 
 // The logError() method is a generic helper for logging an error message.
@@ -16,7 +22,8 @@ func (app *application) logError(r *http.Request, err error) {
 
 	// Use the PrintError() method to log the error message, and include
 	// the current request method and URL as properties in the log entry.
-	app.logger.PrintError(err, map[string]string{
+	app.logger.PrintError(err, jsonlog.Properties{
+		"request_id":     app.contextGetRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -25,56 +32,140 @@ func (app *application) logError(r *http.Request, err error) {
 // For sending JSON-formatted error messages to the client with a given status code.
 // Note that we are using an interface{} type for the message parameter, rather than just a string type, as
 // this gives us more flexibility over the values that we can include in the response.
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
+//
+// The code parameter is a stable, machine-readable identifier for the kind of error. By
+// default the response has the original {"error": message} format, but clients which
+// send an Accept header including application/problem+json get an RFC 7807 problem
+// details object instead, which includes the code.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message interface{}) {
 	env := envelope{"error": message}
+	var headers http.Header
+
+	// Include the request ID, so that the client can quote it when reporting a problem.
+	requestID := app.contextGetRequestID(r)
+	if requestID != "" {
+		env["request_id"] = requestID
+	}
+
+	// The format of the response depends on the Accept header, so let caches know.
+	w.Header().Add("Vary", "Accept")
+
+	if acceptsProblemJSON(r) {
+		env = envelope{
+			"type":     "urn:greenlight:problem:" + code,
+			"title":    http.StatusText(status),
+			"status":   status,
+			"code":     code,
+			"instance": r.URL.Path,
+		}
+
+		if requestID != "" {
+			env["request_id"] = requestID
+		}
+
+		// Validation errors are listed per field, sorted by field name so that the
+		// response is stable. Any other message becomes the detail.
+		switch message := message.(type) {
+		case map[string]string:
+			env["detail"] = "one or more fields failed validation"
+			env["errors"] = fieldErrors(message)
+		default:
+			env["detail"] = message
+		}
+
+		headers = http.Header{"Content-Type": []string{"application/problem+json"}}
+	}
 
 	// If this happens to return an error then log it, and fall back to sending the client
 	// an empty response with 500 Internal Server Error status code.
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeJSON(w, status, env, headers)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
 
+// acceptsProblemJSON returns true if the Accept header of the request includes the
+// application/problem+json media type with a non-zero quality value.
+func acceptsProblemJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil || mediaType != "application/problem+json" {
+				continue
+			}
+
+			if q, ok := params["q"]; ok {
+				if value, err := strconv.ParseFloat(q, 64); err != nil || value == 0 {
+					continue
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// fieldErrors converts the errors map from a Validator into a slice of per-field
+// details, sorted by field name.
+func fieldErrors(errors map[string]string) []map[string]string {
+	fields := make([]string, 0, len(errors))
+	for field := range errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	details := make([]map[string]string, 0, len(fields))
+	for _, field := range fields {
+		details = append(details, map[string]string{
+			"field":  field,
+			"detail": errors[field],
+		})
+	}
+
+	return details
+}
+
 // Used when our application encounters an unexpected problem at runtime.
 // It logs the detailed error message, then send a 500 to the client.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request."
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, "server_error", message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, "not_found", message)
 }
 
 // Used to send a 405 Method Not Allowed status code and JSON response to the client.
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method_not_allowed", message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, "bad_request", err.Error())
 }
 
 // Note that the errors parameter here has the type map[string]string, which is exactly
 // the same as the errors map contained in our Validator type.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "failed_validation", errors)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate_limit_exceeded", message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_credentials", message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
@@ -82,20 +173,20 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_authentication_token", message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "authentication_required", message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "inactive_account", message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account does not have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "not_permitted", message)
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+// For the "GET /v1/genres" endpoint, which lists the genre taxonomy along with the
+// number of movies in each genre.
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.models.Genres.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/able8/greenlight/internal/jsonlog"
+	"github.com/able8/greenlight/migrations"
 )
 
 // Declare a handler which writes a plain-text response.
@@ -55,3 +63,143 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 	// Write the JSON as the HTTP response body.
 	// w.Write([]byte(js))
 }
+
+// The healthCheck type holds the result of one of the readiness checks.
+type healthCheck struct {
+	Status     string      `json:"status"`
+	DurationMS float64     `json:"duration_ms"`
+	Error      string      `json:"error,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+// runHealthCheck times a check and converts its result into a healthCheck.
+func runHealthCheck(fn func() (interface{}, error)) healthCheck {
+	start := time.Now()
+	details, err := fn()
+
+	check := healthCheck{
+		Status:     "ok",
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		Details:    details,
+	}
+	if err != nil {
+		check.Status = "failed"
+		check.Error = err.Error()
+	}
+
+	return check
+}
+
+// For the "GET /v1/healthcheck/live" endpoint. This only shows that the server is
+// running and able to handle requests, so it doesn't check any dependencies.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// For the "GET /v1/healthcheck/ready" endpoint. This checks that the server is able to
+// serve requests properly, and sends a 503 Service Unavailable response if any of the
+// checks fail, or if the server has started shutting down.
+//
+// The endpoint is public, and the errors from the database and SMTP drivers can reveal
+// hostnames, ports and authentication failures, so only the status of each check is
+// sent. The errors are logged instead, and the full results are available from the
+// "GET /debug/healthcheck/ready" endpoint.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks, status, code := app.runReadinessChecks(r)
+
+	public := make(map[string]healthCheck, len(checks))
+	for name, check := range checks {
+		if check.Status != "ok" {
+			app.logger.PrintWarn("readiness check failed", jsonlog.Properties{
+				"check":   name,
+				"error":   check.Error,
+				"details": check.Details,
+			})
+		}
+		public[name] = healthCheck{Status: check.Status, DurationMS: check.DurationMS}
+	}
+
+	err := app.writeJSON(w, code, envelope{"status": status, "checks": public}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// For the "GET /debug/healthcheck/ready" endpoint, which is only available on the admin
+// listener, or to clients who can read the metrics when admin authentication is on. It runs the same checks as readinessHandler(), but includes
+// the errors and details for each check.
+func (app *application) readinessDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	checks, status, code := app.runReadinessChecks(r)
+
+	err := app.writeJSON(w, code, envelope{"status": status, "checks": checks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runReadinessChecks runs the readiness checks, returning the result of each one along
+// with the overall status and the HTTP status code for the response.
+func (app *application) runReadinessChecks(r *http.Request) (map[string]healthCheck, string, int) {
+	checks := make(map[string]healthCheck)
+
+	checks["shutdown"] = runHealthCheck(func() (interface{}, error) {
+		if atomic.LoadInt32(&app.shuttingDown) == 1 {
+			return nil, errors.New("server is shutting down")
+		}
+		return nil, nil
+	})
+
+	checks["database"] = runHealthCheck(func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.healthcheck.dbTimeout)
+		defer cancel()
+
+		return nil, app.db.PingContext(ctx)
+	})
+
+	// The schema version must match the newest migration embedded in the binary, and
+	// the last migration must have completed successfully.
+	checks["schema"] = runHealthCheck(func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.healthcheck.dbTimeout)
+		defer cancel()
+
+		expected, err := migrations.LatestVersion()
+		if err != nil {
+			return nil, err
+		}
+
+		version, dirty, err := schemaVersion(ctx, app.db)
+		if err != nil {
+			return nil, err
+		}
+
+		details := map[string]interface{}{"version": version, "expected": expected, "dirty": dirty}
+
+		switch {
+		case dirty:
+			return details, fmt.Errorf("schema version %d is dirty", version)
+		case version != expected:
+			return details, fmt.Errorf("schema version is %d, expected %d", version, expected)
+		}
+
+		return details, nil
+	})
+
+	if app.config.healthcheck.smtp {
+		checks["smtp"] = runHealthCheck(func() (interface{}, error) {
+			return nil, app.settings().mailer.Check()
+		})
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	return checks, status, code
+}
@@ -5,11 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/able8/greenlight/internal/data"
+	"github.com/able8/greenlight/internal/jsonlog"
 	"github.com/able8/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -31,6 +37,14 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// Retrieve the "locale" URL parameter from the current request context, normalized
+// to the lower-case form that we store in the database.
+func (app *application) readLocaleParam(r *http.Request) string {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	return strings.ToLower(strings.ReplaceAll(params.ByName("locale"), "_", "-"))
+}
+
 // Define a writeJSON() helper for sending response.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	// Encode the data to JSON, returning the error if there was one.
@@ -52,7 +66,11 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	// Default to application/json, unless the caller has provided a more specific
+	// Content-Type in the headers (like application/problem+json).
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	w.WriteHeader(status)
 	w.Write([]byte(js))
 
@@ -137,6 +155,77 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// The readImage() helper reads an uploaded image from the request, which can either be
+// a multipart form containing a file in the given field, or the raw image data. Just
+// like readJSON() we limit the size of the request body, and rather than trusting the
+// Content-Type header sent by the client we sniff the type from the image data itself.
+func (app *application) readImage(w http.ResponseWriter, r *http.Request, field string) ([]byte, error) {
+	// Use http.MaxBytesReader() to limit the size of the request body to 10MB.
+	maxBytes := 10_485_760
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	imageTypes := []string{"image/jpeg", "image/png", "image/gif"}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.New("request must have a valid Content-Type header")
+	}
+
+	var src io.Reader
+
+	switch {
+	case mediaType == "multipart/form-data":
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+
+		// Look through the parts of the form for the file field, ignoring anything else.
+		for src == nil {
+			part, err := mr.NextPart()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, fmt.Errorf("body must contain a %q file", field)
+				}
+				if err.Error() == "http: request body too large" {
+					return nil, fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+				}
+				return nil, err
+			}
+
+			if part.FormName() == field {
+				src = part
+			}
+		}
+
+	case validator.In(mediaType, imageTypes...):
+		src = r.Body
+
+	default:
+		return nil, fmt.Errorf("Content-Type must be multipart/form-data or one of %s", strings.Join(imageTypes, ", "))
+	}
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		switch {
+		case err.Error() == "http: request body too large":
+			return nil, fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		default:
+			return nil, err
+		}
+	}
+
+	if len(body) == 0 {
+		return nil, errors.New("image must not be empty")
+	}
+
+	if !validator.In(http.DetectContentType(body), imageTypes...) {
+		return nil, fmt.Errorf("image must be one of %s", strings.Join(imageTypes, ", "))
+	}
+
+	return body, nil
+}
+
 // The readString() helper returns a string value from the query string, or
 // the provided default value if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -188,8 +277,104 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// The background() helper accepts an arbitrary function as a parameter.
-func (app *application) background(fn func()) {
+// The readRuntimeFormat() helper returns the format that the client wants movie
+// runtimes to be rendered in. The "runtime_format" query string parameter takes
+// precedence over the X-Runtime-Format header, and if neither is present we use
+// the default "<n> mins" format. Unsupported values are recorded in the Validator.
+func (app *application) readRuntimeFormat(r *http.Request, v *validator.Validator) data.RuntimeFormat {
+	format := data.RuntimeFormat(app.readString(r.URL.Query(), "runtime_format", r.Header.Get("X-Runtime-Format")))
+	if format == "" {
+		return data.RuntimeFormatMins
+	}
+
+	data.ValidateRuntimeFormat(v, format)
+
+	return format
+}
+
+// The readLocales() helper returns the client's preferred locales, most preferred
+// first. A comma-separated "lang" query string parameter takes precedence over the
+// Accept-Language header. Each locale is followed by its less specific forms, so
+// that a request for "pt-BR" falls back to "pt" before the default title is used.
+func (app *application) readLocales(r *http.Request) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var tags []weighted
+
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		for _, tag := range strings.Split(lang, ",") {
+			tags = append(tags, weighted{tag: tag, q: 1})
+		}
+	} else {
+		for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+			fields := strings.Split(part, ";")
+			tag := weighted{tag: fields[0], q: 1}
+
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					if err != nil {
+						q = 0
+					}
+					tag.q = q
+				}
+			}
+
+			if tag.q > 0 {
+				tags = append(tags, tag)
+			}
+		}
+
+		// Sort by the quality values, keeping the original order for equal values.
+		sort.SliceStable(tags, func(i, j int) bool {
+			return tags[i].q > tags[j].q
+		})
+	}
+
+	locales := []string{}
+	seen := make(map[string]bool)
+
+	for _, tag := range tags {
+		locale := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag.tag), "_", "-"))
+		if !validator.Matches(locale, data.LocaleRX) {
+			continue
+		}
+
+		for {
+			if !seen[locale] {
+				seen[locale] = true
+				locales = append(locales, locale)
+			}
+
+			i := strings.LastIndex(locale, "-")
+			if i == -1 {
+				break
+			}
+			locale = locale[:i]
+		}
+	}
+
+	return locales
+}
+
+// The background() helper accepts an arbitrary function as a parameter. It also takes
+// the request which started the task, so that a panic in the task is logged with the
+// ID of that request.
+func (app *application) background(r *http.Request, fn func()) {
+	requestID := app.contextGetRequestID(r)
+
+	// Record the task, along with the request which started it, so that it can be
+	// identified if it is abandoned when the server shuts down.
+	task := backgroundTask{RequestID: requestID, Started: time.Now()}
+	if info := app.contextGetRequestInfo(r); info != nil {
+		task.Route = info.route
+	}
+	id := app.tasks.add(task)
+
 	// Increment the WaitGroup counter.
 	app.wg.Add(1)
 
@@ -197,11 +382,14 @@ func (app *application) background(fn func()) {
 	go func() {
 		// User defer to decrement the WaitGroup counter before the goroutine returns.
 		defer app.wg.Done()
+		defer app.tasks.remove(id)
 
 		// Recover any panic
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+				app.logger.PrintError(jsonlog.NewPanicError(err), jsonlog.Properties{
+					"request_id": requestID,
+				})
 			}
 		}()
 
@@ -210,3 +398,54 @@ func (app *application) background(fn func()) {
 	}()
 
 }
+
+// The backgroundTask type describes a goroutine started by background().
+type backgroundTask struct {
+	RequestID string
+	Route     string
+	Started   time.Time
+}
+
+// The taskList type holds the background tasks which are currently running. The zero
+// value is ready to use.
+type taskList struct {
+	mu     sync.Mutex
+	nextID uint64
+	tasks  map[uint64]backgroundTask
+}
+
+func (l *taskList) add(task backgroundTask) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tasks == nil {
+		l.tasks = make(map[uint64]backgroundTask)
+	}
+
+	l.nextID++
+	l.tasks[l.nextID] = task
+	return l.nextID
+}
+
+func (l *taskList) remove(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.tasks, id)
+}
+
+// running returns the tasks which are still running, oldest first.
+func (l *taskList) running() []backgroundTask {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tasks := make([]backgroundTask, 0, len(l.tasks))
+	for _, task := range l.tasks {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Started.Before(tasks[j].Started)
+	})
+
+	return tasks
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomasen/realip"
+)
+
+// splitListenAddr splits a listen address into the network and address to pass to
+// net.Listen(). Addresses like "unix:/run/greenlight/api.sock" are Unix domain
+// sockets, and anything else is a TCP address like ":4000" or "localhost:4001".
+func splitListenAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
+// listenAddr returns the address that the main server listens on. This is the -listen
+// address if it is set, and the -port on all interfaces otherwise.
+func (app *application) listenAddr() string {
+	if app.config.listen.addr != "" {
+		return app.config.listen.addr
+	}
+	return fmt.Sprintf(":%d", app.config.port)
+}
+
+// listen opens a listening socket for the given address. For a Unix domain socket,
+// any stale socket file left behind by a previous process is removed first, and the
+// file mode and ownership of the new socket are set from the configuration. The
+// socket file is removed again when the listener is closed.
+func (app *application) listen(addr string) (net.Listener, error) {
+	network, address := splitListenAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	err := removeStaleSocket(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(address, app.config.listen.socketMode)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	if app.config.listen.socketOwner != "" {
+		uid, gid, err := lookupOwner(app.config.listen.socketOwner)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+
+		// Changing the group of the socket fails unless we're running as root or the
+		// user is a member of the group, so we say so rather than returning a bare
+		// "operation not permitted".
+		err = os.Lchown(address, uid, gid)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("listen: can't change the owner of %s to %s (the user running the API must be a member of the group): %w", address, app.config.listen.socketOwner, err)
+		}
+	}
+
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path, if there is one and nothing is
+// accepting connections on it. This happens when a previous process was killed before
+// it could clean up after itself. It returns an error if the socket is in use, or if
+// the path exists but isn't a socket, as we don't want to delete anything else.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSocket == 0:
+		return fmt.Errorf("listen: %s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("listen: socket %s is in use by another process", path)
+	}
+
+	return os.Remove(path)
+}
+
+// lookupOwner parses an owner like "greenlight" or "greenlight:caddy", where the user
+// and group can be names or numeric IDs. If the group isn't given, the user's primary
+// group is used.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	userName, groupName := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		u, err = user.LookupId(userName)
+		if err != nil {
+			return 0, 0, fmt.Errorf("listen: unknown socket owner %q", userName)
+		}
+	}
+
+	uid, _ = strconv.Atoi(u.Uid)
+	gid, _ = strconv.Atoi(u.Gid)
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("listen: unknown socket group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return uid, gid, nil
+}
+
+// clientIP returns the IP address of the client which made the request. Requests over
+// a Unix domain socket come from a reverse proxy on the same host, and their remote
+// address is just "@" (or empty), so we use the client address that the proxy added
+// to the X-Forwarded-For header instead. That is the last address in the header, as
+// any before it were sent by the client and can't be trusted.
+//
+// Otherwise, we use realip.FromRequest() as before.
+func (app *application) clientIP(r *http.Request) string {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok || addr.Network() != "unix" {
+		return realip.FromRequest(r)
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		addresses := strings.Split(xff, ",")
+		return strings.TrimSpace(addresses[len(addresses)-1])
+	}
+
+	if xRealIP := r.Header.Get("X-Real-Ip"); xRealIP != "" {
+		return xRealIP
+	}
+
+	// The request didn't go through a proxy which sets the headers, so all we know is
+	// that it came from this host.
+	return "unix"
+}
@@ -1,22 +1,58 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
-	"fmt"
+	mathrand "math/rand"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/able8/greenlight/internal/data"
+	"github.com/able8/greenlight/internal/jsonlog"
 	"github.com/able8/greenlight/internal/validator"
 	"github.com/felixge/httpsnoop"
-	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 )
 
+// Declare a regular expression for sanity checking request IDs sent by clients or
+// upstream proxies. Anything else is replaced with a newly generated ID.
+var requestIDRX = regexp.MustCompile("^[a-zA-Z0-9._:-]{1,128}$")
+
+// The requestID() middleware makes sure that every request has an ID, which we include
+// in log entries and error responses so that they can be tied together. An incoming
+// X-Request-ID header is used if it looks sensible, and otherwise we generate a new ID.
+// The ID is always echoed back in the X-Request-ID response header. This middleware
+// also adds an empty requestInfo to the context, for inner handlers to fill in.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+
+		if !requestIDRX.MatchString(requestID) {
+			randomBytes := make([]byte, 16)
+
+			_, err := rand.Read(randomBytes)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			requestID = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+
+		r = app.contextSetRequestID(r, requestID)
+		r = app.contextSetRequestInfo(r, &requestInfo{})
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function which will always be run in the event of
@@ -31,10 +67,11 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 				w.Header().Set("Connection", "close")
 
 				// The value returned by recover() has the type interface{},
-				// so we use fmt.Errorf() to normalize it into an error.
+				// so we use jsonlog.NewPanicError() to normalize it into an error,
+				// which also captures the stack trace of the panic.
 				// This will log the error using our custom Logger type at the
 				// ERROR level and send the client a 500 Internal Server Error response.
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				app.serverErrorResponse(w, r, jsonlog.NewPanicError(err))
 			}
 		}()
 
@@ -58,6 +95,13 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		clients = make(map[string]*client)
 	)
 
+	// Report the number of clients being tracked, as this is what uses memory.
+	app.registry.NewGaugeFunc("greenlight_rate_limiter_clients", "Number of clients tracked by the rate limiter.", func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return float64(len(clients))
+	})
+
 	// Launch a background goroutine which removes old entries from the clients map once every minute.
 	go func() {
 		for {
@@ -82,8 +126,12 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	// limiter := rate.NewLimiter(2, 4)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the current limiter settings, which can change when the configuration
+		// is reloaded.
+		settings := app.settings().limiter
+
 		// Only carry out the check if rate limiting is enabled.
-		if app.config.limiter.enabled {
+		if settings.enabled {
 			// Extract the client's IP address from the request.
 			// ip, _, err := net.SplitHostPort(r.RemoteAddr)
 			// if err != nil {
@@ -91,8 +139,9 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 			// 	return
 			// }
 
-			// Use the realip.FromRequest() function to get the client's read IP address.
-			ip := realip.FromRequest(r)
+			// Use the clientIP() helper to get the client's real IP address, which
+			// uses the realip.FromRequest() function for TCP connections.
+			ip := app.clientIP(r)
 
 			// Lock the mutex to prevent tis code from being executed concurrently.
 			mu.Lock()
@@ -107,7 +156,16 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 				// Use the requests-per-second and burst values from the config struct.
 				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
+					limiter: rate.NewLimiter(rate.Limit(settings.rps), settings.burst)}
+			}
+
+			// If the settings have been reloaded since the client's limiter was created,
+			// update the limiter to match.
+			if clients[ip].limiter.Limit() != rate.Limit(settings.rps) {
+				clients[ip].limiter.SetLimit(rate.Limit(settings.rps))
+			}
+			if clients[ip].limiter.Burst() != settings.burst {
+				clients[ip].limiter.SetBurst(settings.burst)
 			}
 			// update the last seen time for the client.
 			clients[ip].lastSeen = time.Now()
@@ -150,6 +208,28 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// return the empty string if there is no such header found.
 		authorizationHeader := r.Header.Get("Authorization")
 
+		// If there is no Authorization header, but the client presented a certificate
+		// which was verified against the client CA bundle, look up the service user
+		// that the certificate's subjects are mapped to. A certificate with no mapping
+		// gets a 401 Unauthorized response, rather than being treated as anonymous, so
+		// that misconfigured clients fail loudly.
+		if authorizationHeader == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			user, err := app.models.Users.GetForCertificateSubjects(certificateSubjects(r.TLS.VerifiedChains[0][0]))
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidCredentialsResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// If there is no Authorization header found, use the contextSetUser() helper
 		// that we just made to add the AnonymousUser to the request context. Then we
 		// call the next handler in the chain and return without executing any of the code below.
@@ -298,14 +378,20 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		// Get the value of the request's origin header.
 		origin := r.Header.Get("Origin")
 
+		// Read the current trusted origins, which can change when the configuration is reloaded.
+		trustedOrigins := app.settings().cors.trustedOrigins
+
 		// Only run this if there's an Origin request header present AND at lease one trusted origin is configured.
-		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
+		if origin != "" && len(trustedOrigins) != 0 {
 			// Loop through the list of trusted origins, checking to see if the request origin exactly matches one of them.
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
+			for i := range trustedOrigins {
+				if origin == trustedOrigins[i] {
 					// If there is a match, then set the header.
 					w.Header().Set("Access-Control-Allow-Origin", origin)
 
+					// Let browser clients read the request ID from the response.
+					w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
 					// Check if the request has the HTTP method OPTIONS and contains the header.
 					// If it does, then we treat it as a preflight request.
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
@@ -336,6 +422,23 @@ func (app *application) metrics(next http.Handler) http.Handler {
 	// Declare a new expvar map to hold the count of responses for each HTTP status code.
 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
 
+	// Register the request metrics in the Prometheus format. These are broken down
+	// by the route pattern rather than the URL path, so that the number of series
+	// doesn't grow with the number of movies and users.
+	requestsTotal := app.registry.NewCounterVec("greenlight_http_requests_total",
+		"Total number of HTTP requests, by route, method and status.", "method", "route", "status")
+	requestDuration := app.registry.NewHistogramVec("greenlight_http_request_duration_seconds",
+		"HTTP request latencies in seconds, by route and method.", app.config.metrics.latencyBuckets, "method", "route")
+
+	// Publish the same per-route metrics in the expvar handler, keyed by the method and
+	// route pattern like "GET /v1/movies/:id" (with the status too for the counts).
+	expvar.Publish("total_requests_by_route", expvar.Func(func() interface{} {
+		return requestsTotal.Snapshot()
+	}))
+	expvar.Publish("request_duration_seconds_by_route", expvar.Func(func() interface{} {
+		return requestDuration.Snapshot()
+	}))
+
 	// The following code will be run for every request...
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Record the time that we started to process the request.
@@ -360,9 +463,83 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// need to use the strconv.Itoa() function to convert the status code to a string.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
 
+		// Requests which didn't match any route (like 404s for unknown paths) are all
+		// grouped together under a single route label.
+		route := "unmatched"
+		if info := app.contextGetRequestInfo(r); info != nil && info.route != "" {
+			route = info.route
+		}
+
+		// The method comes straight from the client, so any method that we don't
+		// recognise is recorded as "OTHER". Otherwise a client could create any
+		// number of series by sending requests with made-up methods.
+		method := metricsMethod(r.Method)
+
+		requestsTotal.Inc(method, route, strconv.Itoa(metrics.Code))
+		requestDuration.Observe(metrics.Duration.Seconds(), method, route)
+
 		// Calculate the number of microseconds since we began to process the request,
 		// then increment the total processing time by this amount.
 		// duration := time.Since(start).Microseconds()
 		// totalProcessingTimeMicroseconds.Add(duration)
 	})
 }
+
+// metricsMethod returns the label value for a request method, which is either one of
+// the standard methods that we use or "OTHER".
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// The accessLog() middleware writes a log entry for each request, once the response
+// has been sent. Requests for excluded paths are skipped, and only a sample of the
+// remaining requests are logged if a sample rate below 1 is configured. Server errors
+// are always logged, regardless of the sample rate.
+func (app *application) accessLog(next http.Handler) http.Handler {
+	excluded := make(map[string]bool, len(app.config.accessLog.excludePaths))
+	for _, path := range app.config.accessLog.excludePaths {
+		excluded[path] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.accessLog.enabled || excluded[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		if metrics.Code < 500 && mathrand.Float64() >= app.config.accessLog.sampleRate {
+			return
+		}
+
+		properties := jsonlog.Properties{
+			"request_id":  app.contextGetRequestID(r),
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      metrics.Code,
+			"bytes":       metrics.Written,
+			"duration_ms": float64(metrics.Duration.Microseconds()) / 1000,
+			"client_ip":   app.clientIP(r),
+		}
+
+		// The route pattern and user ID are recorded in the requestInfo by the router
+		// and the authenticate() middleware. The route is empty if no route matched.
+		if info := app.contextGetRequestInfo(r); info != nil {
+			if info.route != "" {
+				properties["route"] = info.route
+			}
+			if info.userID != 0 {
+				properties["user_id"] = info.userID
+			}
+		}
+
+		app.logger.PrintInfo("request", properties)
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/able8/greenlight/internal/jsonlog"
+	"github.com/able8/greenlight/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/httpfs"
+)
+
+// migrationLockID is the key for the Postgres advisory lock which is held while
+// migrations are applied on start up. It is an arbitrary number, which just needs to
+// be different from any other advisory lock used with the same database.
+const migrationLockID = 48151623
+
+// newMigrator returns a migrate.Migrate instance which reads the migrations embedded
+// in the binary. It opens its own database connection, as closing the migrator also
+// closes the connection pool that it was given.
+func newMigrator(dsn string) (*migrate.Migrate, error) {
+	source, err := httpfs.New(http.FS(migrations.FS), ".")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("httpfs", source, "postgres", driver)
+}
+
+// runMigrateCommand carries out the "migrate" subcommand. The supported actions are:
+//
+//	up            apply all of the up migrations
+//	down [N]      roll back N migrations (default 1)
+//	goto V        migrate up or down to version V
+//	version       print the current version
+//	force V       set the version without running any migrations, to fix a dirty database
+func runMigrateCommand(cfg config, logger *jsonlog.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: api migrate [flags] up|down [N]|goto V|version|force V")
+	}
+
+	// Read the numeric argument for the actions which need (or allow) one.
+	number := func(required bool, def int) (int, error) {
+		if len(args) < 2 {
+			if required {
+				return 0, fmt.Errorf("migrate %s: a version must be provided", args[0])
+			}
+			return def, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("migrate %s: invalid number %q", args[0], args[1])
+		}
+		return n, nil
+	}
+
+	migrator, err := newMigrator(cfg.db.dsn)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		var n int
+		n, err = number(false, 1)
+		if err == nil {
+			err = migrator.Steps(-n)
+		}
+	case "goto":
+		var v int
+		v, err = number(true, 0)
+		if err == nil {
+			err = migrator.Migrate(uint(v))
+		}
+	case "force":
+		var v int
+		v, err = number(true, 0)
+		if err == nil {
+			err = migrator.Force(v)
+		}
+	case "version":
+		// Handled below.
+	default:
+		return fmt.Errorf("migrate: unknown action %q", args[0])
+	}
+
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, err := migrator.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+
+	logger.PrintInfo("database migrations", jsonlog.Properties{
+		"action":  args[0],
+		"version": version,
+		"dirty":   dirty,
+	})
+
+	return nil
+}
+
+// schemaVersion returns the current schema version of the database, as recorded by
+// golang-migrate in the schema_migrations table.
+func schemaVersion(ctx context.Context, db *sql.DB) (version uint, dirty bool, err error) {
+	err = db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	return version, dirty, err
+}
+
+// migrateOnStart applies any outstanding up migrations when the server starts. It
+// holds a Postgres advisory lock while doing so, so that when several instances are
+// started at once, only one of them runs the migrations and the others wait for it to
+// finish before carrying on.
+func migrateOnStart(cfg config, db *sql.DB, logger *jsonlog.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Advisory locks belong to a session, so we need to lock and unlock using the
+	// same connection rather than the pool.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+	if err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	migrator, err := newMigrator(cfg.db.dsn)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	err = migrator.Up()
+	switch {
+	case errors.Is(err, migrate.ErrNoChange):
+	case err != nil:
+		return err
+	}
+
+	version, _, err := migrator.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+
+	logger.PrintInfo("database migrations applied", jsonlog.Properties{
+		"version": version,
+	})
+
+	return nil
+}
@@ -45,9 +45,24 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Genres:  input.Genres,
 	}
 
+	// Map the genres onto their canonical slugs, so that "Sci-Fi" and "science fiction"
+	// are both stored as "science-fiction".
+	var unknownGenres []string
+	movie.Genres, unknownGenres, err = app.models.Genres.Normalize(movie.Genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// Initialize a new Validator instance.
 	v := validator.New()
 
+	// Reject any genres which aren't part of the taxonomy.
+	data.ValidateKnownGenres(v, unknownGenres)
+
+	// Read the format that the client wants the runtime in the response to use.
+	movie.RuntimeFormat = app.readRuntimeFormat(r, v)
+
 	// // Use the check() method to execute our validation check.
 	// // This will add the provided key and error message to the errors map if the check fails.
 	// v.Check(input.Title != "", "title", "must be provided")
@@ -127,7 +142,16 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// 	Version:   1,
 	// }
 
-	movie, err := app.models.Movies.Get(id)
+	v := validator.New()
+
+	runtimeFormat := app.readRuntimeFormat(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Pick the movie title based on the locales preferred by the client.
+	movie, err := app.models.Movies.GetLocalized(id, app.readLocales(r))
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -138,6 +162,12 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	movie.RuntimeFormat = runtimeFormat
+
+	// The response depends on the Accept-Language and X-Runtime-Format headers, so let caches know.
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Add("Vary", "X-Runtime-Format")
+
 	// Create an envelope{"movie": movie} instance.
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
@@ -208,9 +238,20 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		// Note that we don't need to dereference a slice.
 	}
 
+	var unknownGenres []string
+	movie.Genres, unknownGenres, err = app.models.Genres.Normalize(movie.Genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// Validate the updated movie record, sending the client a 422 Unprocessable Entity response if any checks fail.
 	v := validator.New()
 
+	data.ValidateKnownGenres(v, unknownGenres)
+
+	movie.RuntimeFormat = app.readRuntimeFormat(r, v)
+
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -254,6 +295,15 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Remove any poster files for the movie. A failure here doesn't affect the
+	// response, as the movie itself has already been deleted, so we just log it.
+	for size := range data.PosterSizes {
+		err = app.storage.Delete(data.PosterKey(id, size))
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
 	// Return a 200 OK status code along with a success message.
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -284,6 +334,15 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
 
+	// Normalize the genres filter in the same way as when a movie is saved, so that
+	// filtering on an alias like "sci-fi" matches the stored "science-fiction" slug.
+	genres, _, err := app.models.Genres.Normalize(input.Genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	input.Genres = genres
+
 	// Get the page and page_size query string values as integers.
 	// Notice that we set the default page value to 1 and default page_size to 20,
 	// and that we pass the validator instance as the final argument here.
@@ -294,8 +353,10 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// if it is not provided by the client.
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 
+	runtimeFormat := app.readRuntimeFormat(r, v)
+
 	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "rating", "-id", "-title", "-year", "-runtime", "-rating"}
 
 	// Check the Validator interface for any errors and use the failedVlidationResponse() helper
 	// to send the client a response if necessary.
@@ -306,7 +367,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	// Call the GetAll() method to retrieve the movies, passing in
 	// the various filters parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, app.readLocales(r), input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -315,6 +376,13 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// Dump the contents of the input struct in a HTTP response.
 	// fmt.Fprintf(w, "%+v\n", input)
 
+	for _, movie := range movies {
+		movie.RuntimeFormat = runtimeFormat
+	}
+
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Add("Vary", "X-Runtime-Format")
+
 	// Send a JSON response containing the movie data.
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movies, "metadata": metadata}, nil)
 	if err != nil {
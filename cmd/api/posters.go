@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+
+	// Register the GIF and PNG decoders with the image package. The JPEG decoder is
+	// registered by the image/jpeg import above.
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/able8/greenlight/internal/data"
+	"github.com/able8/greenlight/internal/storage"
+	"github.com/able8/greenlight/internal/thumbnail"
+	"github.com/able8/greenlight/internal/validator"
+)
+
+// For the "PUT /v1/movies/:id/poster" endpoint. The uploaded image is stored as-is,
+// along with a JPEG thumbnail for each of the sizes in data.PosterSizes.
+func (app *application) uploadPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	body, err := app.readImage(w, r, "poster")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Check the image dimensions before decoding it, so that we don't allocate a
+	// huge amount of memory for a small but maliciously crafted file.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("image could not be decoded"))
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(cfg.Width <= 8000 && cfg.Height <= 8000, "poster", "must not be larger than 8000x8000 pixels")
+	v.Check(cfg.Width >= 100 && cfg.Height >= 100, "poster", "must be at least 100x100 pixels")
+	v.Check(cfg.Width*cfg.Height <= thumbnail.MaxPixels, "poster", "must not have more than 24 megapixels")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	img, err := thumbnail.Decode(body)
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("image could not be decoded"))
+		return
+	}
+
+	// Convert the image for resizing once, rather than for every thumbnail size.
+	src := thumbnail.NewSource(img)
+
+	for size, width := range data.PosterSizes {
+		if width == 0 {
+			err = app.storage.Put(data.PosterKey(movie.ID, size), bytes.NewReader(body))
+		} else {
+			var buf bytes.Buffer
+			err = jpeg.Encode(&buf, src.Resize(width), &jpeg.Options{Quality: 85})
+			if err == nil {
+				err = app.storage.Put(data.PosterKey(movie.ID, size), &buf)
+			}
+		}
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.Movies.SetPoster(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// For the "GET /v1/movies/:id/poster?size=" endpoint.
+func (app *application) showPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	size := app.readString(r.URL.Query(), "size", "original")
+	if _, ok := data.PosterSizes[size]; !ok {
+		v.AddError("size", "invalid size value")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if movie.PosterUpdatedAt == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	f, err := app.storage.Open(data.PosterKey(movie.ID, size))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	// http.ServeContent() sniffs the Content-Type from the file, and handles the
+	// If-Modified-Since and Range headers for us.
+	http.ServeContent(w, r, "", *movie.PosterUpdatedAt, f)
+}
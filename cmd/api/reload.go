@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/able8/greenlight/internal/jsonlog"
+	"github.com/able8/greenlight/internal/mailer"
+	"github.com/able8/greenlight/internal/validator"
+)
+
+// The liveSettings type holds the settings which can be changed while the server is
+// running, along with the mailer built from the SMTP settings. A new liveSettings is
+// stored in app.live each time the configuration is reloaded, so handlers always see a
+// consistent set of settings without needing a lock.
+type liveSettings struct {
+	limiter struct {
+		rps     float64
+		burst   int
+		enabled bool
+	}
+	cors struct {
+		trustedOrigins []string
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	logLevel jsonlog.Level
+	mailer   mailer.Mailer
+}
+
+// newLiveSettings copies the reloadable settings out of a config struct.
+func newLiveSettings(cfg config) *liveSettings {
+	s := &liveSettings{logLevel: cfg.logLevel}
+	s.limiter = cfg.limiter
+	s.cors = cfg.cors
+	s.smtp = cfg.smtp
+	s.mailer = mailer.New(s.smtp.host, s.smtp.port, s.smtp.username, s.smtp.password, s.smtp.sender)
+	return s
+}
+
+// settings returns the current reloadable settings.
+func (app *application) settings() *liveSettings {
+	return app.live.Load().(*liveSettings)
+}
+
+// reloadConfig reads the configuration again, from the same command-line arguments,
+// config file and environment as at start up, and swaps in any changes to the
+// reloadable settings. It returns the names of the settings which changed. Changes to
+// any other settings are ignored until the server is restarted.
+func (app *application) reloadConfig() ([]string, error) {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	cfg, _, err := parseConfig(fs, app.args)
+	if err == nil {
+		v := validator.New()
+		if validateConfig(v, cfg); !v.Valid() {
+			err = errors.New("invalid configuration: " + strings.Join(configProblems(v.Errors), ", "))
+		}
+	}
+	if err != nil {
+		app.logger.PrintError(err, jsonlog.Properties{"action": "reload configuration"})
+		return nil, err
+	}
+
+	current := app.settings()
+	next := newLiveSettings(cfg)
+
+	// Start with an empty slice rather than nil, so that no changes are logged and
+	// sent as [] rather than null.
+	changed := []string{}
+	if next.limiter != current.limiter {
+		changed = append(changed, "limiter")
+	}
+	if strings.Join(next.cors.trustedOrigins, " ") != strings.Join(current.cors.trustedOrigins, " ") {
+		changed = append(changed, "cors")
+	}
+	if next.smtp != current.smtp {
+		changed = append(changed, "smtp")
+	} else {
+		next.mailer = current.mailer
+	}
+
+	// The log level can also be changed with the PUT /debug/log-level endpoint, so we
+	// only change it if the configured level has changed.
+	if next.logLevel != current.logLevel {
+		changed = append(changed, "log-level")
+		app.logger.SetLevel(next.logLevel)
+	}
+
+	app.live.Store(next)
+
+	app.logger.PrintInfo("configuration reloaded", jsonlog.Properties{
+		"changed": changed,
+	})
+
+	return changed, nil
+}
+
+// For the "POST /debug/reload-config" endpoint, which does the same as sending the
+// process a SIGHUP signal.
+func (app *application) reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	changed, err := app.reloadConfig()
+	if err != nil {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "failed_validation", err.Error())
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"changed": changed}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -9,8 +9,9 @@ import (
 
 // Update the routes() method to return a http.Handler instead of a *httprouter.Router.
 func (app *application) routes() http.Handler {
-	// Initialize a new httprouter router instance.
-	router := httprouter.New()
+	// Initialize a new httprouter router instance, wrapped so that the route pattern
+	// for each request is recorded for use in logs.
+	router := patternRouter{Router: httprouter.New(), app: app}
 
 	// Convert the notFoundResponse() helper to a http.Handler using the
 	// http.HandlerFunc() adapter, and then set it as the custom error handler for 404 Not Found responses.
@@ -23,6 +24,8 @@ func (app *application) routes() http.Handler {
 	// Register the relevant methods, URL patterns and handler functions for our
 	// endpoints using th HandlerFunc() method.
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/live", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/ready", app.readinessHandler)
 
 	// Use the requirePermission() middleware on each of the /v1/movies endpoints,
 	// passing in the required permission code as the first parameter.
@@ -34,16 +37,50 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
 
+	// Posters are uploaded as a separate resource, so that the movie endpoints can keep accepting JSON.
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/poster", app.requirePermission("movies:write", app.uploadPosterHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/poster", app.requirePermission("movies:read", app.showPosterHandler))
+
+	// Localized titles are managed per locale, e.g. PUT /v1/movies/1/titles/pt-br.
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/titles", app.requirePermission("movies:read", app.listMovieTitlesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/titles/:locale", app.requirePermission("movies:write", app.putMovieTitleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/titles/:locale", app.requirePermission("movies:write", app.deleteMovieTitleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.requirePermission("movies:read", app.listGenresHandler))
+
+	// Any activated user can rate and review a movie, but only their own review can be changed.
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requireActivatedUser(app.showReviewHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requireActivatedUser(app.createReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id/reviews", app.requireActivatedUser(app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/reviews", app.requireActivatedUser(app.deleteReviewHandler))
+
+	// Collections can be read by anyone who can read movies, but creating and editing
+	// them needs the "collections:write" permission.
+	router.HandlerFunc(http.MethodGet, "/v1/collections", app.requirePermission("movies:read", app.listCollectionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/collections", app.requirePermission("collections:write", app.createCollectionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/collections/:id", app.requirePermission("movies:read", app.showCollectionHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/collections/:id", app.requirePermission("collections:write", app.updateCollectionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/collections/:id", app.requirePermission("collections:write", app.deleteCollectionHandler))
+
 	// Add the route for the POST /v1/users endpoint.
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 
 	// Add the route for the PUT /v1/users/activated endpoint.
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
+	// The watchlist endpoints always act on the watchlist of the authenticated user.
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlist", app.requireActivatedUser(app.listWatchlistHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/watchlist", app.requireActivatedUser(app.addWatchlistItemHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/watchlist/:id", app.requireActivatedUser(app.updateWatchlistItemHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/watchlist/:id", app.requireActivatedUser(app.deleteWatchlistItemHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
-	// Register a new endpoint pointing to the expvar handler.
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	// The debug and metrics endpoints are only served by the public router if there
+	// is no separate admin listener.
+	if app.config.admin.addr == "" {
+		app.debugRoutes(router)
+	}
 
 	// Return the httprouter instance
 	// Wrap the router with the panic recovery middleware
@@ -51,5 +88,79 @@ func (app *application) routes() http.Handler {
 	// Use the authenticate() middleware on all requests.
 	// Add the enableCORS() middleware
 	// Use the new metrics() middleware at the start of the chain.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// The requestID() middleware comes first of all, so that every log entry and error
+	// response for the request can include its ID.
+	return app.requestID(app.accessLog(app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))))
+}
+
+// The adminRoutes() method returns the handler for the admin listener, which serves the
+// debug and metrics endpoints plus the pprof handlers. It doesn't use the rate limiter
+// or CORS middleware, as it is not meant to be reachable from the internet.
+func (app *application) adminRoutes() http.Handler {
+	router := patternRouter{Router: httprouter.New(), app: app}
+
+	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+
+	app.debugRoutes(router)
+
+	// The pprof handlers are registered under a catch-all parameter, as httprouter
+	// doesn't allow the named profiles to sit alongside a wildcard segment.
+	router.HandlerFunc(http.MethodGet, "/debug/pprof/*item", app.requireMetricsAccess(app.pprofHandler))
+	router.HandlerFunc(http.MethodPost, "/debug/pprof/*item", app.requireMetricsAccess(app.pprofHandler))
+
+	// Bearer tokens aren't used with basic authentication, so there's no need for the
+	// authenticate() middleware in that case.
+	if app.config.admin.auth == "basic" {
+		return app.requestID(app.recoverPanic(router))
+	}
+
+	return app.requestID(app.recoverPanic(app.authenticate(router)))
+}
+
+// The debugRoutes() method registers the debug and metrics endpoints on a router.
+func (app *application) debugRoutes(router patternRouter) {
+	// Register a new endpoint pointing to the expvar handler.
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requireMetricsAccess(expvar.Handler().ServeHTTP))
+
+	// The same metrics (and more) are available in the Prometheus text format.
+	router.HandlerFunc(http.MethodGet, "/metrics", app.requireMetricsAccess(app.registry.Handler().ServeHTTP))
+
+	// The readiness checks with their error messages, which aren't shown publicly. The
+	// errors can include database and SMTP hostnames, so unlike the other debug routes,
+	// this is only served on the admin listener or when admin authentication is on. It
+	// is never served without authentication on the main port.
+	if app.config.admin.addr != "" || app.config.admin.auth != "none" {
+		router.HandlerFunc(http.MethodGet, "/debug/healthcheck/ready", app.requireMetricsAccess(app.readinessDetailsHandler))
+	}
+
+	// The minimum log level can be read by anyone who can read the metrics, but changing
+	// it needs the "admin:write" permission (or the admin basic auth credentials).
+	router.HandlerFunc(http.MethodGet, "/debug/log-level", app.requireMetricsAccess(app.showLogLevelHandler))
+	router.HandlerFunc(http.MethodPut, "/debug/log-level", app.requireAdminWrite(app.updateLogLevelHandler))
+
+	// Reloading the configuration does the same as sending the process a SIGHUP signal.
+	router.HandlerFunc(http.MethodPost, "/debug/reload-config", app.requireAdminWrite(app.reloadConfigHandler))
+}
+
+// The patternRouter type wraps a httprouter.Router, so that each handler records the
+// route pattern that it was registered with (like "/v1/movies/:id") in the requestInfo
+// for the request. This lets outer middleware refer to the route without using the
+// raw URL path.
+type patternRouter struct {
+	*httprouter.Router
+	app *application
+}
+
+func (pr patternRouter) Handler(method, path string, handler http.Handler) {
+	pr.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := pr.app.contextGetRequestInfo(r); info != nil {
+			info.route = path
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func (pr patternRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	pr.Handler(method, path, handler)
 }
@@ -2,28 +2,193 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/able8/greenlight/internal/jsonlog"
 )
 
 func (app *application) serve() error {
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		Addr:              app.listenAddr(),
+		Handler:           app.routes(),
+		IdleTimeout:       app.config.server.idleTimeout,
+		ReadTimeout:       app.config.server.readTimeout,
+		ReadHeaderTimeout: app.config.server.readHeaderTimeout,
+		WriteTimeout:      app.config.server.writeTimeout,
+		MaxHeaderBytes:    app.config.server.maxHeaderBytes,
+	}
+
+	// Set up HTTPS if it is enabled. The certificate is either loaded from the files
+	// (and reloaded when they change), or generated at start up.
+	useTLS := app.config.tls.certFile != "" || app.config.tls.selfSigned
+
+	// The certificate reloader stops checking for changes when serve() returns.
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+
+	switch {
+	case app.config.tls.certFile != "":
+		cr, err := newCertReloader(reloadCtx, app.config.tls.certFile, app.config.tls.keyFile, 30*time.Second, app.logger)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = newTLSConfig(cr.GetCertificate)
+
+	case app.config.tls.selfSigned:
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = newTLSConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert, nil
+		})
+	}
+
+	// If a client CA bundle is configured, ask clients for a certificate and verify any
+	// that they send against it. Clients without a certificate can still connect and
+	// authenticate with a token, so we don't require one.
+	if useTLS && app.config.tls.clientCAFile != "" {
+		pool, err := loadCertPool(app.config.tls.clientCAFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// If configured, create a plain HTTP server which redirects to HTTPS.
+	var redirectSrv *http.Server
+	if app.config.tls.redirectAddr != "" {
+		redirectSrv = &http.Server{
+			Addr:              app.config.tls.redirectAddr,
+			Handler:           app.redirectToHTTPS(),
+			IdleTimeout:       time.Minute,
+			ReadTimeout:       10 * time.Second,
+			ReadHeaderTimeout: app.config.server.readHeaderTimeout,
+			WriteTimeout:      10 * time.Second,
+			MaxHeaderBytes:    app.config.server.maxHeaderBytes,
+		}
+	}
+
+	// If an admin listener address is configured, create a second server for the
+	// debug and metrics endpoints. Profiles can take a while to collect, so we allow
+	// a longer write timeout than the main server.
+	var adminSrv *http.Server
+	if app.config.admin.addr != "" {
+		adminSrv = &http.Server{
+			Addr:              app.config.admin.addr,
+			Handler:           app.adminRoutes(),
+			IdleTimeout:       time.Minute,
+			ReadTimeout:       10 * time.Second,
+			ReadHeaderTimeout: app.config.server.readHeaderTimeout,
+			WriteTimeout:      2 * time.Minute,
+			MaxHeaderBytes:    app.config.server.maxHeaderBytes,
+		}
+	}
+
+	// Open the listening sockets. If the process was started by systemd socket
+	// activation, we use the sockets that it passed to us instead, so that connections
+	// are queued by the kernel (rather than refused) while the service restarts.
+	activated, err := activatedListeners()
+	if err != nil {
+		return err
+	}
+	socketActivated := len(activated) > 0
+	upgradeReady := upgradeReadyFile()
+
+	// The owned map records the Unix domain sockets which we created ourselves, and so
+	// remove when we shut down. Sockets from systemd belong to the socket unit, so we
+	// must leave them in place.
+	owned := make(map[string]bool)
+
+	listen := func(name, addr string) (net.Listener, error) {
+		if ln, ok := activated[name]; ok {
+			delete(activated, name)
+			return ln, nil
+		}
+
+		ln, err := app.listen(addr)
+		if _, ok := ln.(*net.UnixListener); ok {
+			owned[name] = true
+		}
+		return ln, err
+	}
+
+	ln, err := listen("api", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	var adminLn, redirectLn net.Listener
+	if adminSrv != nil {
+		adminLn, err = listen("admin", adminSrv.Addr)
+		if err != nil {
+			return err
+		}
+	}
+	if redirectSrv != nil {
+		redirectLn, err = listen("redirect", redirectSrv.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep track of the sockets that we're serving, so that they can be passed on to a
+	// new process by an upgrade.
+	listeners := map[string]net.Listener{"api": ln}
+	if adminLn != nil {
+		listeners["admin"] = adminLn
+	}
+	if redirectLn != nil {
+		listeners["redirect"] = redirectLn
+	}
+
+	// Sockets inherited from the process that we're upgrading from are left in place
+	// when we close them, unless that process created them itself (rather than getting
+	// them from systemd), in which case they are now ours to remove.
+	if upgradeReady != nil {
+		for _, name := range upgradeUnlinkNames() {
+			if ul, ok := listeners[name].(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(true)
+				owned[name] = true
+			}
+		}
+	}
+
+	// Any remaining sockets don't match a server that we're running, probably because
+	// of a mismatch between the socket unit and our configuration.
+	for name, ln := range activated {
+		app.logger.PrintWarn("closing unused activated socket", jsonlog.Properties{
+			"name": name,
+			"addr": ln.Addr().String(),
+		})
+		ln.Close()
 	}
 
 	// Create a shutdownError channel. We will use this to receive any errors
 	// returned by the graceful Shutdown() function.
 	shutdownError := make(chan error)
 
+	// Start a background goroutine which reloads the configuration whenever the process
+	// receives a SIGHUP signal. Any errors are logged by reloadConfig(), and the server
+	// keeps running with the previous settings.
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		for range hup {
+			app.reloadConfig()
+		}
+	}()
+
 	// Start a background goroutine
 	go func() {
 		// Create a quit channel which carries os.Signal values.
@@ -34,38 +199,121 @@ func (app *application) serve() error {
 		// adn will retain their default behavior.
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-		// Read the signal from the quit channel. This code will block until a signal is received.
-		s := <-quit
+		// A SIGUSR2 signal starts an upgrade: we start the executable again (which has
+		// usually been replaced by a new version), pass our sockets to it, and shut
+		// down once it is ready. Requests are served by one process or the other
+		// throughout, so no connections are refused.
+		usr2 := make(chan os.Signal, 1)
+		signal.Notify(usr2, syscall.SIGUSR2)
+
+		upgraded := make(chan error, 1)
+		upgrading := false
+
+		// If the systemd watchdog is enabled, let it know that we're still alive at the
+		// interval that it asks for. If we hang, systemd will restart the service.
+		var watchdog <-chan time.Time
+		if interval := watchdogInterval(); interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			watchdog = ticker.C
+		}
+
+		// Read the signal from the quit channel. This code will block until a signal is
+		// received or an upgrade has completed, sending the watchdog notifications in
+		// the meantime. The upgrade runs in its own goroutine, so that the watchdog
+		// notifications carry on while we wait for the new process.
+		var s os.Signal
+		for s == nil {
+			select {
+			case s = <-quit:
+			case <-watchdog:
+				app.notify("WATCHDOG=1")
+			case <-usr2:
+				if upgrading {
+					continue
+				}
+				upgrading = true
+				go func() {
+					upgraded <- app.upgrade(listeners, owned)
+				}()
+			case err := <-upgraded:
+				upgrading = false
+				if err != nil {
+					app.logger.PrintError(err, nil)
+					continue
+				}
+				s = syscall.SIGUSR2
+			}
+		}
 
 		// Log a message to say that the signal has been caught. Notice that
 		// we also call the String() method on the signal to get the
 		// signal name and include it in the log entry properties.
-		app.logger.PrintInfo("caught signal, shutting down server", map[string]string{
+		app.logger.PrintInfo("caught signal, shutting down server", jsonlog.Properties{
 			"signal": s.String(),
 		})
 
-		// Create a context  with a 5-second timeout.
+		// Make the readiness check fail straight away, so that load balancers stop
+		// sending new requests while the existing ones are completed.
+		atomic.StoreInt32(&app.shuttingDown, 1)
+
+		// After an upgrade the service carries on in the new process, so we only tell
+		// systemd that it's stopping if we are shutting down for good.
+		if s != syscall.SIGUSR2 {
+			app.notify("STOPPING=1")
+		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		// Create a context with the shutdown timeout, which is 5 seconds by default.
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.server.shutdownTimeout)
 		defer cancel()
 
-		// 	Call Shutdown() on the server like before, but now we only seed on the
-		// shutdownError channel if it returns an error.
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
+		// Call Shutdown() on the server like before. If it fails (usually because
+		// requests were still running when the shutdown timeout expired), we hold on to
+		// the error and only send it on the shutdownError channel after draining the
+		// background tasks, so that they still get their chance to complete.
+		shutdownErr := srv.Shutdown(ctx)
+
+		// Also shut down the admin server, if there is one. We don't wait for it to
+		// drain properly, as it only serves debugging and monitoring requests.
+		if adminSrv != nil {
+			adminSrv.Close()
+		}
+		if redirectSrv != nil {
+			redirectSrv.Close()
 		}
 
 		// Log a message to say that we're watting for any background goroutine to complete their tasks.
-		app.logger.PrintInfo("completing background tasks", map[string]string{
-			"addr": srv.Addr,
+		app.logger.PrintInfo("completing background tasks", jsonlog.Properties{
+			"addr":    srv.Addr,
+			"timeout": app.config.server.drainTimeout,
 		})
 
 		// Call Wait() to block until our WaitGroup counter is zero --- essentially
-		// blocking until the background goroutines have finished. Then we return nil
-		// on the shutdownError channel, to indicate that the shutdown completed without any issues.
-		app.wg.Wait()
-		shutdownError <- nil
+		// blocking until the background goroutines have finished. Then we send the
+		// result of Shutdown() on the shutdownError channel, which is nil if the
+		// shutdown completed without any issues.
+		//
+		// A task can hang (for example, sending an email to an unresponsive SMTP
+		// server), so we only wait for up to the drain timeout. Any tasks which are
+		// still running after that are logged and abandoned when the process exits.
+		drained := make(chan struct{})
+		go func() {
+			app.wg.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-time.After(app.config.server.drainTimeout):
+			for _, task := range app.tasks.running() {
+				app.logger.PrintWarn("abandoned background task", jsonlog.Properties{
+					"request_id": task.RequestID,
+					"route":      task.Route,
+					"running":    time.Since(task.Started).Round(time.Millisecond),
+				})
+			}
+		}
+		shutdownError <- shutdownErr
 
 		// Call Shutdown() on our server, passing in the context we just made.
 		// It will return nil if the graceful shutdown was successful, or an error.
@@ -76,11 +324,43 @@ func (app *application) serve() error {
 		// os.Exit(0)
 	}()
 
-	app.logger.PrintInfo("Starting server", map[string]string{
-		"addr": srv.Addr,
-		"env":  app.config.env,
+	app.logger.PrintInfo("Starting server", jsonlog.Properties{
+		"addr":             ln.Addr().String(),
+		"env":              app.config.env,
+		"tls":              useTLS,
+		"socket_activated": socketActivated,
 	})
 
+	// Start the admin server in the background. If it fails to start, we log the error
+	// and carry on serving the public API.
+	if adminSrv != nil {
+		app.logger.PrintInfo("Starting admin server", jsonlog.Properties{
+			"addr": adminSrv.Addr,
+			"auth": app.config.admin.auth,
+		})
+
+		go func() {
+			err := adminSrv.Serve(adminLn)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, jsonlog.Properties{
+					"addr": adminSrv.Addr,
+				})
+			}
+		}()
+	}
+
+	// Likewise for the HTTP to HTTPS redirect server.
+	if redirectSrv != nil {
+		go func() {
+			err := redirectSrv.Serve(redirectLn)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, jsonlog.Properties{
+					"addr": redirectSrv.Addr,
+				})
+			}
+		}()
+	}
+
 	// Start the server as normal, returning any error.
 	// return srv.ListenAndServe()
 
@@ -88,7 +368,18 @@ func (app *application) serve() error {
 	// return a http.ErrServerClosed error. So if we see this error, it is
 	// actually a good thing and an indication that the graceful shutdown has started.
 	// So we check specifically for this, only returning the error if it it NOT.
-	err := srv.ListenAndServe()
+	// When serving HTTPS, the certificate comes from the TLS config, so we pass empty
+	// file names to ServeTLS(). It also enables HTTP/2 for us.
+	//
+	// All of the sockets are already listening at this point, so we can tell systemd
+	// that we're ready to accept connections.
+	app.ready(upgradeReady)
+
+	if useTLS {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -103,7 +394,7 @@ func (app *application) serve() error {
 
 	// At this point we know that the graceful shutdown completed successfully and
 	// we log a "stopped server" message.
-	app.logger.PrintInfo("stopped server", map[string]string{
+	app.logger.PrintInfo("stopped server", jsonlog.Properties{
 		"addr": srv.Addr,
 	})
 
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/able8/greenlight/internal/jsonlog"
+)
+
+// The first file descriptor passed by systemd socket activation. File descriptors 0, 1
+// and 2 are stdin, stdout and stderr, so the sockets start at 3.
+const listenFdsStart = 3
+
+// activatedListeners returns the listening sockets passed to the process by systemd
+// socket activation, keyed by their name. The name is set with FileDescriptorName= in
+// the socket unit, and defaults to the name of the unit without the .socket suffix. The
+// main server uses the "api" socket, and the admin and redirect servers use the "admin"
+// and "redirect" sockets. A single socket is used for the main server unless it's named
+// for one of the others, so a single socket unit works without naming it.
+//
+// It returns an empty map if the process wasn't socket activated. The environment
+// variables are unset afterwards, so that they aren't inherited by child processes.
+func activatedListeners() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	defer os.Unsetenv("GREENLIGHT_UPGRADE_PID")
+
+	// The sockets are only meant for us if LISTEN_PID matches our process ID. When the
+	// sockets are passed on by an upgrade, the parent can't know our process ID in
+	// advance, so instead it sets GREENLIGHT_UPGRADE_PID to its own.
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		ppid, err := strconv.Atoi(os.Getenv("GREENLIGHT_UPGRADE_PID"))
+		if err != nil || ppid != os.Getppid() {
+			return listeners, nil
+		}
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return listeners, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = strings.TrimSuffix(names[i], ".socket")
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		// FileListener() duplicates the file descriptor, so we close the original
+		// whether or not it succeeded.
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation: file descriptor %d (%s): %w", fd, name, err)
+		}
+
+		listeners[name] = ln
+	}
+
+	// A single socket with a name that we don't recognise is used for the main server.
+	if n == 1 {
+		for name, ln := range listeners {
+			if name != "admin" && name != "redirect" {
+				delete(listeners, name)
+				listeners["api"] = ln
+			}
+		}
+	}
+
+	return listeners, nil
+}
+
+// sdNotify sends a state change notification, like "READY=1", to the service manager.
+// It does nothing if the NOTIFY_SOCKET environment variable isn't set, which is the
+// case when the API isn't run by systemd with Type=notify. This implements the
+// protocol directly, so that we don't need to depend on libsystemd.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+
+	// A leading @ means that the socket is in the abstract namespace.
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify sends a notification to the service manager, logging any error. Failing to
+// notify systemd isn't fatal, although with Type=notify it will eventually time out
+// waiting for the service to start.
+func (app *application) notify(state string) {
+	err := sdNotify(state)
+	if err != nil {
+		app.logger.PrintError(err, jsonlog.Properties{"state": state})
+	}
+}
+
+// watchdogInterval returns the interval at which the service manager expects to receive
+// "WATCHDOG=1" notifications, or zero if the watchdog isn't enabled for this process.
+// It is half of the configured WatchdogSec=, as recommended by sd_watchdog_enabled(3).
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if s := os.Getenv("WATCHDOG_PID"); s != "" {
+		pid, err := strconv.Atoi(s)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
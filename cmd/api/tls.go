@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/able8/greenlight/internal/jsonlog"
+)
+
+// newTLSConfig returns the TLS configuration for the main server. It only allows TLS
+// 1.2 and above, with forward-secret AEAD cipher suites and modern curves. The cipher
+// suites only apply to TLS 1.2, as Go doesn't allow them to be configured for TLS 1.3
+// (where all of the supported suites are secure).
+func newTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		GetCertificate: getCertificate,
+	}
+}
+
+// The certReloader type holds the TLS certificate for the server, and reloads it when
+// the certificate or key file changes on disk. This lets certificates be renewed (by
+// certbot, for example) without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *jsonlog.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate and key, returning an error if they can't be
+// loaded, and then checks the files for changes every interval until ctx is cancelled.
+func newCertReloader(ctx context.Context, certFile, keyFile string, interval time.Duration, logger *jsonlog.Logger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			modTime, err := cr.latestModTime()
+			if err != nil || !modTime.After(cr.loadedModTime()) {
+				continue
+			}
+
+			// If the new files can't be loaded (for example because only one of them
+			// has been replaced so far), keep using the old certificate and try again
+			// next time.
+			err = cr.reload()
+			if err != nil {
+				cr.logger.PrintError(err, jsonlog.Properties{"cert_file": certFile})
+				continue
+			}
+
+			cr.logger.PrintInfo("reloaded TLS certificate", jsonlog.Properties{"cert_file": certFile})
+		}
+	}()
+
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+
+	return nil
+}
+
+// latestModTime returns the most recent modification time of the two files.
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (cr *certReloader) loadedModTime() time.Time {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.modTime
+}
+
+// GetCertificate is used as the tls.Config.GetCertificate function.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates from a file.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", name)
+	}
+
+	return pool, nil
+}
+
+// certificateSubjects returns the names from a verified client certificate which can
+// be mapped to a user: the subject common name, followed by the DNS names, email
+// addresses and URIs from the subject alternative name extension.
+func certificateSubjects(cert *x509.Certificate) []string {
+	var subjects []string
+
+	if cert.Subject.CommonName != "" {
+		subjects = append(subjects, cert.Subject.CommonName)
+	}
+	subjects = append(subjects, cert.DNSNames...)
+	subjects = append(subjects, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+
+	return subjects
+}
+
+// selfSignedCertificate generates a certificate for localhost which is valid for one
+// year. It is only meant for development, and browsers and clients will warn about it
+// unless told to trust it.
+func selfSignedCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"Greenlight development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// redirectToHTTPS returns a handler which redirects every request to the same URL on
+// the HTTPS server.
+func (app *application) redirectToHTTPS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+
+		// Use the port that the main server listens on. If it's a Unix domain socket,
+		// HTTPS is served by a proxy in front of us, on the standard port.
+		port := strconv.Itoa(app.config.port)
+		if network, address := splitListenAddr(app.listenAddr()); network == "unix" {
+			port = "443"
+		} else if _, p, err := net.SplitHostPort(address); err == nil {
+			port = p
+		}
+
+		switch {
+		case port != "443":
+			host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+
+		// Use a 308 Permanent Redirect, so that clients repeat the request with the
+		// same method and body.
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/able8/greenlight/internal/jsonlog"
+)
+
+// How long we wait for the new process to start serving before giving up on an upgrade.
+const upgradeTimeout = 30 * time.Second
+
+// upgradeReadyFile returns the write end of the pipe that the parent process passed to
+// us if we were started by an upgrade, or nil otherwise. We close it once we are ready
+// to accept connections, which tells the parent that it can shut down.
+func upgradeReadyFile() *os.File {
+	defer os.Unsetenv("GREENLIGHT_UPGRADE_READY_FD")
+
+	fd, err := strconv.Atoi(os.Getenv("GREENLIGHT_UPGRADE_READY_FD"))
+	if err != nil || fd < listenFdsStart {
+		return nil
+	}
+
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), "upgrade-ready")
+}
+
+// upgradeUnlinkNames returns the names of the sockets that the parent process passed to
+// us which it created itself, and which we should remove when we shut down.
+func upgradeUnlinkNames() []string {
+	defer os.Unsetenv("GREENLIGHT_UPGRADE_UNLINK")
+
+	return strings.FieldsFunc(os.Getenv("GREENLIGHT_UPGRADE_UNLINK"), func(r rune) bool {
+		return r == ','
+	})
+}
+
+// ready tells systemd and, after an upgrade, the parent process that we are accepting
+// connections.
+func (app *application) ready(upgradeReady *os.File) {
+	// When we were started by an upgrade, the parent is still the main process as far as
+	// systemd is concerned, and the service is already marked as ready. The parent tells
+	// systemd about us once it has heard from us, so we don't send anything ourselves.
+	if upgradeReady != nil {
+		upgradeReady.Write([]byte("READY=1"))
+		upgradeReady.Close()
+		return
+	}
+
+	app.notify("READY=1")
+}
+
+// upgrade starts a new copy of the API from the executable on disk, which might have
+// been replaced with a new version since we were started, and passes the listening
+// sockets to it. It uses the same LISTEN_FDS and LISTEN_FDNAMES variables as systemd
+// socket activation, so the new process picks the sockets up with activatedListeners().
+//
+// It returns once the new process is ready to accept connections, at which point both
+// processes are accepting connections from the same sockets and we can shut down. If the
+// new process exits or doesn't become ready in time, it is killed and an error is
+// returned, and we carry on as before.
+//
+// The owned map holds the names of the Unix domain sockets which we created ourselves.
+// The new process removes those when it shuts down, but leaves any from systemd alone.
+func (app *application) upgrade(listeners map[string]net.Listener, owned map[string]bool) error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Duplicate the file descriptor for each listener. The new process receives these
+	// as file descriptors 3 and up, in the order of the ExtraFiles slice.
+	var files []*os.File
+	var names, unlink []string
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for name, ln := range listeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("upgrade: can't pass %s listener of type %T", name, ln)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f)
+		names = append(names, name)
+		if owned[name] {
+			unlink = append(unlink, name)
+		}
+	}
+
+	// The new process closes the write end of this pipe when it's ready. If it exits
+	// before then, the pipe is closed when it exits.
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWrite)
+	cmd.Env = append(upgradeEnviron(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"GREENLIGHT_UPGRADE_PID="+strconv.Itoa(os.Getpid()),
+		"GREENLIGHT_UPGRADE_READY_FD="+strconv.Itoa(listenFdsStart+len(files)),
+		"GREENLIGHT_UPGRADE_UNLINK="+strings.Join(unlink, ","),
+	)
+
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("started new process for upgrade", jsonlog.Properties{
+		"pid":  cmd.Process.Pid,
+		"path": path,
+	})
+
+	// Reap the new process if we give up on it, so that it doesn't become a zombie.
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		msg, err := io.ReadAll(readyRead)
+		switch {
+		case err != nil:
+			ready <- err
+		case string(msg) != "READY=1":
+			ready <- errors.New("upgrade: new process exited before becoming ready")
+		default:
+			ready <- nil
+		}
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("upgrade: new process wasn't ready after %s", upgradeTimeout)
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		<-exited
+		return err
+	}
+
+	// The new process becomes the main process of the service once we exit, so we tell
+	// systemd about it before we start shutting down. The new process is using our
+	// Unix domain sockets now, so we mustn't remove them when we close our listeners.
+	app.notify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid))
+	setUnlinkOnClose(listeners, false)
+
+	return nil
+}
+
+// setUnlinkOnClose sets whether the socket files of any Unix domain socket listeners are
+// removed when the listeners are closed.
+func setUnlinkOnClose(listeners map[string]net.Listener, unlink bool) {
+	for _, ln := range listeners {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(unlink)
+		}
+	}
+}
+
+// upgradeEnviron returns our environment for the new process, without the variables
+// which only apply to this process.
+func upgradeEnviron() []string {
+	var env []string
+
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		switch name {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID",
+			"GREENLIGHT_UPGRADE_PID", "GREENLIGHT_UPGRADE_READY_FD", "GREENLIGHT_UPGRADE_UNLINK":
+			continue
+		}
+		env = append(env, kv)
+	}
+
+	return env
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/able8/greenlight/internal/data"
+	"github.com/able8/greenlight/internal/jsonlog"
 	"github.com/able8/greenlight/internal/validator"
 )
 
@@ -101,8 +102,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Include the request ID in the log entries written by the background task, so
+	// that they can be tied back to this request.
+	logger := app.logger.With(jsonlog.Properties{"request_id": app.contextGetRequestID(r)})
+
 	// Use the background helper to execute an anonymous function that sends the welcome email.
-	app.background(func() {
+	app.background(r, func() {
 		// As there are now nultiple pieces of data that we want to pass to our email
 		// templates, we create a map to act as  a holding structure for the data.
 		// This contains the plaintext versino of the activation token for the user,
@@ -113,13 +118,15 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 
 		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl.html", data)
+		err = app.settings().mailer.Send(user.Email, "user_welcome.tmpl.html", data)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.mailSent.Inc("failure")
+			logger.PrintError(err, nil)
 			return
 		}
+		app.mailSent.Inc("success")
 
-		app.logger.PrintInfo("Send email successfully", map[string]string{
+		logger.PrintInfo("Send email successfully", jsonlog.Properties{
 			"email": user.Email,
 		})
 	})
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/able8/greenlight/internal/data"
+	"github.com/able8/greenlight/internal/validator"
+)
+
+// For the "GET /v1/users/me/watchlist" endpoint.
+func (app *application) listWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Default to the user's own ordering of the list.
+	input.Filters.Sort = app.readString(qs, "sort", "position")
+	input.Filters.SortSafelist = []string{"position", "title", "year", "added_at", "watched_at", "-position", "-title", "-year", "-added_at", "-watched_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	items, metadata, err := app.models.Watchlist.GetAllForUser(user.ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"watchlist": items, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// For the "POST /v1/users/me/watchlist" endpoint.
+func (app *application) addWatchlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	// The position is optional. If it isn't provided the movie is added to the end of the list.
+	var input struct {
+		MovieID   int64      `json:"movie_id"`
+		Position  int32      `json:"position"`
+		Watched   bool       `json:"watched"`
+		WatchedAt *time.Time `json:"watched_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	item := &data.WatchlistItem{
+		UserID:    user.ID,
+		MovieID:   input.MovieID,
+		Position:  input.Position,
+		Watched:   input.Watched,
+		WatchedAt: input.WatchedAt,
+	}
+
+	// Record the time that the movie was watched if the client didn't give us one.
+	if item.Watched && item.WatchedAt == nil {
+		now := time.Now()
+		item.WatchedAt = &now
+	}
+
+	v := validator.New()
+
+	if data.ValidateWatchlistItem(v, item); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Look up the movie so that we can send a 422 response if it doesn't exist, and so
+	// that we can include its details in the response.
+	movie, err := app.models.Movies.Get(item.MovieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", "must refer to an existing movie")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	item.Title = movie.Title
+	item.Year = movie.Year
+
+	err = app.models.Watchlist.Insert(item)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateWatchlistItem):
+			v.AddError("movie_id", "this movie is already on your watchlist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/users/me/watchlist/%d", item.MovieID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"watchlist_item": item}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// For the "PATCH /v1/users/me/watchlist/:id" endpoint, where :id is the movie ID.
+func (app *application) updateWatchlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	item, err := app.models.Watchlist.Get(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Position  *int32     `json:"position"`
+		Watched   *bool      `json:"watched"`
+		WatchedAt *time.Time `json:"watched_at"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Position != nil {
+		item.Position = *input.Position
+	}
+
+	// Marking a movie as unwatched clears the watched date, and marking it as watched
+	// without an explicit date records the current time.
+	if input.Watched != nil {
+		item.Watched = *input.Watched
+		if !item.Watched {
+			item.WatchedAt = nil
+		} else if item.WatchedAt == nil {
+			now := time.Now()
+			item.WatchedAt = &now
+		}
+	}
+	if input.WatchedAt != nil {
+		item.WatchedAt = input.WatchedAt
+	}
+
+	v := validator.New()
+
+	v.Check(item.Position >= 1, "position", "must be greater than zero")
+	if data.ValidateWatchlistItem(v, item); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Watchlist.Update(item)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"watchlist_item": item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// For the "DELETE /v1/users/me/watchlist/:id" endpoint, where :id is the movie ID.
+func (app *application) deleteWatchlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Watchlist.Delete(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully removed from watchlist"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
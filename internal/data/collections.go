@@ -0,0 +1,329 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/able8/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Define a custom ErrUnknownMovie error, returned when a collection refers to a movie
+// which doesn't exist.
+var (
+	ErrUnknownMovie = errors.New("unknown movie")
+)
+
+// Collection is a named, ordered list of movies curated by a user. Private collections
+// are only visible to their owner.
+type Collection struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	OwnerID     int64     `json:"owner_id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Public      bool      `json:"public"`
+	MovieIDs    []int64   `json:"movie_ids"` // The order of the IDs is the order of the collection.
+	Version     int32     `json:"version"`
+}
+
+// VisibleTo returns true if the collection can be seen by the given user.
+func (c *Collection) VisibleTo(user *User) bool {
+	return c.Public || c.OwnerID == user.ID
+}
+
+func ValidateCollection(v *validator.Validator, collection *Collection) {
+	v.Check(collection.Title != "", "title", "must be provided")
+	v.Check(len(collection.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(len(collection.Description) <= 5000, "description", "must not be more than 5000 bytes long")
+
+	v.Check(collection.MovieIDs != nil, "movie_ids", "must be provided")
+	v.Check(len(collection.MovieIDs) <= 1000, "movie_ids", "must not contain more than 1000 movies")
+
+	seen := make(map[int64]bool)
+	for _, id := range collection.MovieIDs {
+		v.Check(id > 0, "movie_ids", "must only contain positive integers")
+		v.Check(!seen[id], "movie_ids", "must not contain duplicate values")
+		seen[id] = true
+	}
+}
+
+// Define a CollectionModel struct type which wraps a sql.DB connection pool.
+type CollectionModel struct {
+	DB *sql.DB
+}
+
+// checkMovies returns ErrUnknownMovie if any of the movie IDs don't exist in the movies table.
+// It runs in the same transaction as the insert or update, and locks the movie records
+// with FOR KEY SHARE, so the movies can't be deleted before the transaction commits.
+func (m CollectionModel) checkMovies(ctx context.Context, tx *sql.Tx, movieIDs []int64) error {
+	if len(movieIDs) == 0 {
+		return nil
+	}
+
+	query := `
+		SELECT count(*)
+		FROM (SELECT id FROM movies WHERE id = ANY($1) FOR KEY SHARE) AS m
+	`
+
+	var count int
+	err := tx.QueryRowContext(ctx, query, pq.Array(movieIDs)).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count != len(movieIDs) {
+		return ErrUnknownMovie
+	}
+
+	return nil
+}
+
+// setMovies replaces the movies in a collection with the given movie IDs, in order.
+// The movies are stored in the collections_movies join table, so that deleting a movie
+// also removes it from any collections.
+func (m CollectionModel) setMovies(ctx context.Context, tx *sql.Tx, collectionID int64, movieIDs []int64) error {
+	query := `
+		DELETE FROM collections_movies
+		WHERE collection_id = $1
+	`
+
+	_, err := tx.ExecContext(ctx, query, collectionID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO collections_movies (collection_id, movie_id, position)
+		SELECT $1, m.movie_id, m.position
+		FROM unnest($2::bigint[]) WITH ORDINALITY AS m (movie_id, position)
+	`
+
+	_, err = tx.ExecContext(ctx, query, collectionID, pq.Array(movieIDs))
+	return err
+}
+
+// Insert a new record in the collections table, along with its movies.
+func (m CollectionModel) Insert(collection *Collection) error {
+	query := `
+		INSERT INTO collections (owner_id, title, description, public)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+
+	args := []interface{}{
+		collection.OwnerID,
+		collection.Title,
+		collection.Description,
+		collection.Public,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.checkMovies(ctx, tx, collection.MovieIDs)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&collection.ID, &collection.CreatedAt, &collection.Version)
+	if err != nil {
+		return err
+	}
+
+	err = m.setMovies(ctx, tx, collection.ID, collection.MovieIDs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get a specific record from the collections table.
+func (m CollectionModel) Get(id int64) (*Collection, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, owner_id, title, description, public,
+			ARRAY(SELECT movie_id FROM collections_movies WHERE collection_id = collections.id ORDER BY position),
+			version
+		FROM collections
+		WHERE id = $1
+	`
+
+	var collection Collection
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&collection.ID,
+		&collection.CreatedAt,
+		&collection.OwnerID,
+		&collection.Title,
+		&collection.Description,
+		&collection.Public,
+		pq.Array(&collection.MovieIDs),
+		&collection.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &collection, nil
+}
+
+// GetAll returns the public collections along with any private collections owned by
+// the given user.
+func (m CollectionModel) GetAll(title string, userID int64, filters Filters) ([]*Collection, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, owner_id, title, description, public,
+			ARRAY(SELECT movie_id FROM collections_movies WHERE collection_id = collections.id ORDER BY position),
+			version
+		FROM collections
+		WHERE (public OR owner_id = $1)
+		AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4
+	`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{userID, title, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	collections := []*Collection{}
+
+	for rows.Next() {
+		var collection Collection
+
+		err := rows.Scan(
+			&totalRecords,
+			&collection.ID,
+			&collection.CreatedAt,
+			&collection.OwnerID,
+			&collection.Title,
+			&collection.Description,
+			&collection.Public,
+			pq.Array(&collection.MovieIDs),
+			&collection.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		collections = append(collections, &collection)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return collections, metadata, nil
+}
+
+// Update a specific record in the collections table and replace its movies, using the
+// version number to prevent edit conflicts in the same way as MovieModel.Update().
+func (m CollectionModel) Update(collection *Collection) error {
+	query := `
+		UPDATE collections
+		SET title = $1, description = $2, public = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version
+	`
+
+	args := []interface{}{
+		collection.Title,
+		collection.Description,
+		collection.Public,
+		collection.ID,
+		collection.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.checkMovies(ctx, tx, collection.MovieIDs)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&collection.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = m.setMovies(ctx, tx, collection.ID, collection.MovieIDs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete a specific record from the collections table.
+func (m CollectionModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM collections
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/able8/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Declare a regular expression which matches runs of characters that aren't allowed in
+// a genre slug. This must be kept in step with the normalization used in the migrations.
+var genreSlugRX = regexp.MustCompile("[^a-z0-9]+")
+
+// Genre is an entry in the managed genre taxonomy. Movies store the canonical slug of
+// each of their genres, and any of the aliases can be used by clients in its place.
+type Genre struct {
+	ID         int64    `json:"id"`
+	Slug       string   `json:"slug"`
+	Name       string   `json:"name"`
+	Aliases    []string `json:"aliases,omitempty"`
+	MovieCount int      `json:"movie_count"`
+}
+
+// genreSlug normalizes a free-text genre into slug form, so that "Sci-Fi", "sci fi"
+// and "SCI_FI" are all treated as "sci-fi".
+func genreSlug(value string) string {
+	return strings.Trim(genreSlugRX.ReplaceAllString(strings.ToLower(value), "-"), "-")
+}
+
+// ValidateKnownGenres rejects any genres which GenreModel.Normalize() couldn't map
+// onto the taxonomy.
+func ValidateKnownGenres(v *validator.Validator, unknown []string) {
+	v.Check(len(unknown) == 0, "genres", fmt.Sprintf("must only contain known genres (unknown: %s)", strings.Join(unknown, ", ")))
+}
+
+// Define a GenreModel struct type which wraps a sql.DB connection pool.
+type GenreModel struct {
+	DB *sql.DB
+}
+
+// GetAll returns every genre in the taxonomy, along with its aliases and the number
+// of movies which have that genre.
+func (m GenreModel) GetAll() ([]*Genre, error) {
+	query := `
+		SELECT genres.id, genres.slug, genres.name,
+			ARRAY(
+				SELECT alias FROM genre_aliases
+				WHERE genre_aliases.genre_id = genres.id AND alias <> genres.slug
+				ORDER BY alias
+			),
+			count(movies.id)
+		FROM genres
+		LEFT JOIN movies ON genres.slug = ANY(movies.genres)
+		GROUP BY genres.id
+		ORDER BY genres.slug
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(
+			&genre.ID,
+			&genre.Slug,
+			&genre.Name,
+			pq.Array(&genre.Aliases),
+			&genre.MovieCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+// Normalize maps each of the provided genres onto its canonical slug. Values which
+// don't match any known genre or alias are returned in slug form in the first slice,
+// and also listed in the second slice so that the caller can decide whether to reject
+// them. Duplicate slugs are removed, keeping the order of the first occurrence of
+// each. A nil or empty input is returned unchanged.
+func (m GenreModel) Normalize(values []string) ([]string, []string, error) {
+	if len(values) == 0 {
+		return values, nil, nil
+	}
+
+	aliases := make([]string, len(values))
+	for i, value := range values {
+		aliases[i] = genreSlug(value)
+	}
+
+	query := `
+		SELECT genre_aliases.alias, genres.slug
+		FROM genre_aliases
+		INNER JOIN genres ON genres.id = genre_aliases.genre_id
+		WHERE genre_aliases.alias = ANY($1)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(aliases))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	canonical := make(map[string]string)
+
+	for rows.Next() {
+		var alias, slug string
+
+		err := rows.Scan(&alias, &slug)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		canonical[alias] = slug
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Different spellings of the same genre, like "Sci-Fi" and "sci fi", map onto the
+	// same slug, so we only keep the first occurrence of each slug.
+	slugs := make([]string, 0, len(aliases))
+	unknown := []string{}
+	seen := make(map[string]bool)
+
+	for i, alias := range aliases {
+		slug, ok := canonical[alias]
+		if !ok {
+			slug = alias
+		}
+
+		if seen[slug] {
+			continue
+		}
+		seen[slug] = true
+
+		slugs = append(slugs, slug)
+		if !ok {
+			unknown = append(unknown, values[i])
+		}
+	}
+
+	return slugs, unknown, nil
+}
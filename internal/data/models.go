@@ -17,6 +17,11 @@ type Models struct {
 	Users       UserModel
 	Tokens      TokenModel
 	Permissions PermissionModel
+	Reviews     ReviewModel
+	Watchlist   WatchlistModel
+	Collections CollectionModel
+	Genres      GenreModel
+	MovieTitles MovieTitleModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct
@@ -27,5 +32,10 @@ func NewModels(db *sql.DB) Models {
 		Users:       UserModel{DB: db}, // Initialize a new UserModel instance.
 		Tokens:      TokenModel{DB: db},
 		Permissions: PermissionModel{DB: db},
+		Reviews:     ReviewModel{DB: db},
+		Watchlist:   WatchlistModel{DB: db},
+		Collections: CollectionModel{DB: db},
+		Genres:      GenreModel{DB: db},
+		MovieTitles: MovieTitleModel{DB: db},
 	}
 }
@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -21,6 +22,75 @@ type Movie struct {
 	Runtime   Runtime   `json:"runtime,omitempty"` // Movie runtime in minutes
 	Genres    []string  `json:"genres,omitempty"`  // Slice of genres for the movie, romance, comedy, etc.
 	Version   int32     `json:"version"`           // The version number will be incremented each time the information is updated.
+	// The average rating and number of ratings are calculated from the reviews table,
+	// so they are read-only and never written back by Insert() or Update().
+	AverageRating float64 `json:"average_rating"`
+	RatingCount   int32   `json:"rating_count"`
+	// PosterUpdatedAt is nil if no poster has been uploaded for the movie. Otherwise
+	// the Poster field holds the URL for each of the available poster sizes.
+	PosterUpdatedAt *time.Time        `json:"-"`
+	Poster          map[string]string `json:"poster,omitempty"`
+	// When a movie is read with a list of preferred locales, Title holds the best
+	// matching localized title and TitleLocale is set to its locale. TitleLocale is
+	// empty if the default title from the movies table was used.
+	TitleLocale   string `json:"title_locale,omitempty"`
+	OriginalTitle string `json:"original_title,omitempty"`
+	// RuntimeFormat controls how the runtime is rendered when the movie is encoded
+	// to JSON. The zero value gives the default "<n> mins" format.
+	RuntimeFormat RuntimeFormat `json:"-"`
+}
+
+// MarshalJSON encodes the movie as normal, except that the runtime is rendered in
+// the movie's RuntimeFormat.
+func (movie Movie) MarshalJSON() ([]byte, error) {
+	// Declaring a new type based on Movie gives us all of its fields without its
+	// methods, so that calling json.Marshal() below doesn't recurse forever.
+	type movieAlias Movie
+
+	// The Runtime field in the outer struct hides the one in the embedded struct.
+	aux := struct {
+		movieAlias
+		Runtime interface{} `json:"runtime,omitempty"`
+	}{
+		movieAlias: movieAlias(movie),
+	}
+
+	if movie.Runtime != 0 {
+		aux.Runtime = movie.Runtime.Value(movie.RuntimeFormat)
+	}
+
+	return json.Marshal(aux)
+}
+
+// PosterSizes maps the name of each poster size onto its width in pixels. The
+// "original" size has a width of zero, and is the image exactly as it was uploaded.
+var PosterSizes = map[string]int{
+	"original": 0,
+	"small":    185,
+	"medium":   342,
+	"large":    780,
+}
+
+// PosterKey returns the storage key for a movie's poster at the given size.
+func PosterKey(movieID int64, size string) string {
+	if size == "original" {
+		return fmt.Sprintf("movies/%d/poster/original", movieID)
+	}
+	return fmt.Sprintf("movies/%d/poster/%s.jpg", movieID, size)
+}
+
+// setPosterURLs fills in the Poster field if the movie has a poster.
+func (movie *Movie) setPosterURLs() {
+	if movie.PosterUpdatedAt == nil {
+		movie.Poster = nil
+		return
+	}
+
+	movie.Poster = make(map[string]string, len(PosterSizes))
+	for size := range PosterSizes {
+		// Include the upload time in the URL so that caches see a new poster as a new resource.
+		movie.Poster[size] = fmt.Sprintf("/v1/movies/%d/poster?size=%s&v=%d", movie.ID, size, movie.PosterUpdatedAt.Unix())
+	}
 }
 
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
@@ -52,8 +122,17 @@ func (m MovieModel) Insert(movie *Movie) error {
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
-// Get a specific record from the movies table.
+// Get a specific record from the movies table, with its default title. Use this
+// rather than GetLocalized() when the movie is going to be updated, so that a
+// localized title is never written back to the movies table.
 func (m MovieModel) Get(id int64) (*Movie, error) {
+	return m.GetLocalized(id, nil)
+}
+
+// GetLocalized gets a specific record from the movies table, picking the title for
+// the first of the given locales which the movie has a localized title for. If there
+// are no matches, the default title is used.
+func (m MovieModel) GetLocalized(id int64, locales []string) (*Movie, error) {
 	// The PostgresSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shotcut
@@ -65,8 +144,22 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// Define the SQL query for retrieving the movie data.
 	// Update the query to return pg_sleep(10) as the first value.
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, COALESCE(localized.title, movies.title), year, runtime, genres, version,
+			COALESCE(ratings.average_rating, 0), COALESCE(ratings.rating_count, 0), poster_updated_at,
+			COALESCE(localized.locale, ''), COALESCE(original.title, '')
 		FROM movies
+		LEFT JOIN (
+			SELECT movie_id, round(avg(rating), 1) AS average_rating, count(*) AS rating_count
+			FROM reviews
+			GROUP BY movie_id
+		) ratings ON ratings.movie_id = movies.id
+		LEFT JOIN LATERAL (
+			SELECT locale, title FROM movie_titles
+			WHERE movie_titles.movie_id = movies.id AND locale = ANY($2)
+			ORDER BY array_position($2, locale)
+			LIMIT 1
+		) localized ON true
+		LEFT JOIN movie_titles original ON original.movie_id = movies.id AND original.original
 		WHERE id = $1
 	`
 
@@ -86,7 +179,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// User the QueryRowContext() method to execute the query,
 	// passing in the context with the deadline as the first argument.
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, pq.Array(locales)).Scan(
 		// Imprtantly, update the Scan() parameters so that the
 		// pg_sleep(10) return value is scanned into a byte slice.
 		// &[]byte{},
@@ -97,6 +190,11 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.AverageRating,
+		&movie.RatingCount,
+		&movie.PosterUpdatedAt,
+		&movie.TitleLocale,
+		&movie.OriginalTitle,
 	)
 
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -110,10 +208,41 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		}
 	}
 
+	movie.setPosterURLs()
+
 	// Otherwise, return a pointer to the Movie struct.
 	return &movie, nil
 }
 
+// SetPoster records that a new poster has been uploaded for the movie. This doesn't
+// change the movie's version number, as the poster is stored separately from the
+// rest of the movie data.
+func (m MovieModel) SetPoster(movie *Movie) error {
+	query := `
+		UPDATE movies
+		SET poster_updated_at = NOW()
+		WHERE id = $1
+		RETURNING poster_updated_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movie.ID).Scan(&movie.PosterUpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	movie.setPosterURLs()
+
+	return nil
+}
+
 // Update a specific record in the movies table.
 func (m MovieModel) Update(movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new version number.
@@ -211,17 +340,42 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain deplicate values")
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(title string, genres []string, locales []string, filters Filters) ([]*Movie, Metadata, error) {
 	// Create a new GetAll() method whch returns a slice of movies.
 
 	// Add an ORDER BY clause and interpolate the sort column and direction. Importantly notice that we also include a secondary sort on the movie ID to ensure a consistent ordering.
 
 	// Update the SQL query to include the window function which
 	// counts the total (filtered) records.
+	// The "rating" alias lets the average rating be used as a sort column, and the
+	// "title" alias means that sorting by title uses the localized titles. The title
+	// search matches the default title or any of the localized titles.
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, COALESCE(localized.title, movies.title) AS title, year, runtime, genres, version,
+			COALESCE(ratings.average_rating, 0) AS rating, COALESCE(ratings.rating_count, 0), poster_updated_at,
+			COALESCE(localized.locale, ''), COALESCE(original.title, '')
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		LEFT JOIN (
+			SELECT movie_id, round(avg(rating), 1) AS average_rating, count(*) AS rating_count
+			FROM reviews
+			GROUP BY movie_id
+		) ratings ON ratings.movie_id = movies.id
+		LEFT JOIN LATERAL (
+			SELECT locale, title FROM movie_titles
+			WHERE movie_titles.movie_id = movies.id AND locale = ANY($5)
+			ORDER BY array_position($5, locale)
+			LIMIT 1
+		) localized ON true
+		LEFT JOIN movie_titles original ON original.movie_id = movies.id AND original.original
+		WHERE (
+			to_tsvector('simple', movies.title) @@ plainto_tsquery('simple', $1)
+			OR EXISTS (
+				SELECT 1 FROM movie_titles
+				WHERE movie_titles.movie_id = movies.id
+				AND to_tsvector('simple', movie_titles.title) @@ plainto_tsquery('simple', $1)
+			)
+			OR $1 = ''
+		)
 		AND (genres @> $2 OR $2 = '{}')
 		ORDER BY %s %s, id ASC
 		LIMIT $3 OFFSET $4
@@ -233,7 +387,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// As our SQL query now has quite a few placeholder parameters, let's collect the values
 	// for placeholders in a slice. Notice here how we call the limit() and offset() methods on the Filters struct to get the appropriate values for
 	// the LIMIT and OFFSET clause.
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset(), pq.Array(locales)}
 	// This returns a sql.Rows resultset containing the result.
 	// Pass the title and genres as the placholder. parameters values.
 	// rows, err := m.DB.QueryContext(ctx, query, title, pq.Array(genres))
@@ -264,11 +418,18 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.PosterUpdatedAt,
+			&movie.TitleLocale,
+			&movie.OriginalTitle,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
 
+		movie.setPosterURLs()
+
 		// fmt.Printf("%+v\n", movie)
 		// Add the Movie struct to the slice.
 		movies = append(movies, &movie)
@@ -3,17 +3,53 @@ package data
 import (
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/able8/greenlight/internal/validator"
 )
 
 // Define an error that out UnmarshalJSON() method can return if we are unable to
-// parse or convert the JSON string successfully.
-var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
+// parse or convert the JSON string successfully. The message lists the formats that
+// we accept, as it is sent to the client in the 400 Bad Request response.
+var ErrInvalidRuntimeFormat = errors.New(`invalid runtime format: must be an integer number of minutes, or a string like "102 mins", "1h 42m" or "PT1H42M"`)
+
+// Declare regular expressions for the "1h 42m" style of runtime and for ISO 8601
+// durations. Both require at least one of the hours or minutes components, which we
+// check after matching. The first also covers a plain number of minutes like "102" or
+// "102 mins", and accepts the longer units like "hr", "hours", "min" and "minutes".
+var (
+	runtimeHMRX  = regexp.MustCompile(`^(?i)(?:(\d+)\s*(?:hours|hour|hrs|hr|h))?\s*(?:(\d+)\s*(minutes|minute|mins|min|m)?)?$`)
+	runtimeISORX = regexp.MustCompile(`^(?i)PT(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?$`)
+)
 
 // Declare a custom Runtime type.
 type Runtime int32
 
+// RuntimeFormat controls how a Runtime value is rendered in responses.
+type RuntimeFormat string
+
+const (
+	RuntimeFormatMins    RuntimeFormat = "mins"    // "102 mins" (the default)
+	RuntimeFormatMinutes RuntimeFormat = "minutes" // 102
+	RuntimeFormatHM      RuntimeFormat = "hm"      // "1h 42m"
+	RuntimeFormatISO8601 RuntimeFormat = "iso8601" // "PT1H42M"
+)
+
+// RuntimeFormats lists the supported values for a RuntimeFormat.
+var RuntimeFormats = []string{
+	string(RuntimeFormatMins),
+	string(RuntimeFormatMinutes),
+	string(RuntimeFormatHM),
+	string(RuntimeFormatISO8601),
+}
+
+func ValidateRuntimeFormat(v *validator.Validator, format RuntimeFormat) {
+	v.Check(validator.In(string(format), RuntimeFormats...), "runtime_format", "must be one of "+strings.Join(RuntimeFormats, ", "))
+}
+
 // Implement a MarshalJSON() method on the Runtime type so that it
 // statisfies the json.Marshaler interface.
 func (r Runtime) MarshalJSON() ([]byte, error) {
@@ -27,37 +63,121 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 	return []byte(quotedJSONValue), nil
 }
 
+// Value returns the runtime rendered in the given format, ready to be encoded as
+// JSON. The "minutes" format is a number, and all of the others are strings.
+func (r Runtime) Value(format RuntimeFormat) interface{} {
+	switch format {
+	case RuntimeFormatMinutes:
+		return int32(r)
+	case RuntimeFormatHM:
+		switch {
+		case r < 60:
+			return fmt.Sprintf("%dm", r)
+		case r%60 == 0:
+			return fmt.Sprintf("%dh", r/60)
+		default:
+			return fmt.Sprintf("%dh %dm", r/60, r%60)
+		}
+	case RuntimeFormatISO8601:
+		switch {
+		case r < 60:
+			return fmt.Sprintf("PT%dM", r)
+		case r%60 == 0:
+			return fmt.Sprintf("PT%dH", r/60)
+		default:
+			return fmt.Sprintf("PT%dH%dM", r/60, r%60)
+		}
+	default:
+		return fmt.Sprintf("%d mins", r)
+	}
+}
+
 // Note that because UnmarshalJSON() needs to modify the receiver (our Runtime type), we must
 // use a pointer receiver for this to work correctly. Otherwise, we will only be modifying
 // a copy (which is then discarded when this method is returned).
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-	// We expect that the incoming JSON value will be a string in the format at
-	// "<runtime> mins", and the first thing we need to do is remove the surrounding
-	// double quotes from the string.
-	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	// A bare JSON number is treated as a number of minutes.
+	if len(jsonValue) > 0 && jsonValue[0] != '"' {
+		i, err := strconv.ParseInt(string(jsonValue), 10, 32)
+		if err != nil {
+			return ErrInvalidRuntimeFormat
+		}
 
-	if err != nil {
-		return ErrInvalidRuntimeFormat
+		*r = Runtime(i)
+		return nil
 	}
 
-	// Split the string to isolate the part containing the number.
-	parts := strings.Split(unquotedJSONValue, " ")
-
-	// Sanity check the parts of the string to make sure it was in the exected format.
-	if len(parts) != 2 || parts[1] != "mins" {
+	// Otherwise we expect a JSON string, and the first thing we need to do is remove
+	// the surrounding double quotes from it.
+	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
 		return ErrInvalidRuntimeFormat
 	}
 
-	// Otherwise, parse the string containing the number into adn int32.
-	i, err := strconv.ParseInt(parts[0], 10, 32)
+	runtime, err := ParseRuntime(unquotedJSONValue)
 	if err != nil {
-		return ErrInvalidRuntimeFormat
+		return err
 	}
 
-	// Convert the int32 to a Runtime type and assign this to the receiver.
 	// Note that we use the * operator to deference the receiver (which is a pointer to
 	// a Runtime type) in order to set the underlying value of the pointer.
-	*r = Runtime(i)
+	*r = runtime
 
 	return nil
 }
+
+// ParseRuntime parses a runtime in any of the supported string formats: "102",
+// "102 mins", "1h 42m", "1h 42min", "1 hour 42 minutes" and ISO 8601 durations like
+// "PT1H42M". Units are case-insensitive, and seconds in an ISO 8601 duration are
+// rounded to the nearest minute.
+func ParseRuntime(s string) (Runtime, error) {
+	s = strings.TrimSpace(s)
+
+	var minutes float64
+
+	switch {
+	case runtimeISORX.MatchString(s):
+		parts := runtimeISORX.FindStringSubmatch(s)
+		if parts[1] == "" && parts[2] == "" && parts[3] == "" {
+			return 0, ErrInvalidRuntimeFormat
+		}
+
+		hours, _ := strconv.ParseFloat(orZero(parts[1]), 64)
+		mins, _ := strconv.ParseFloat(orZero(parts[2]), 64)
+		secs, _ := strconv.ParseFloat(orZero(parts[3]), 64)
+		minutes = math.Round(hours*60 + mins + secs/60)
+
+	case runtimeHMRX.MatchString(s):
+		parts := runtimeHMRX.FindStringSubmatch(s)
+		if parts[1] == "" && parts[2] == "" {
+			return 0, ErrInvalidRuntimeFormat
+		}
+
+		// A number without a unit is only taken as minutes on its own, so that
+		// something like "1h 42" is rejected rather than guessed at.
+		if parts[1] != "" && parts[2] != "" && parts[3] == "" {
+			return 0, ErrInvalidRuntimeFormat
+		}
+
+		hours, _ := strconv.ParseFloat(orZero(parts[1]), 64)
+		mins, _ := strconv.ParseFloat(orZero(parts[2]), 64)
+		minutes = hours*60 + mins
+
+	default:
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	if minutes > math.MaxInt32 {
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	return Runtime(minutes), nil
+}
+
+// orZero returns "0" in place of an empty regular expression submatch.
+func orZero(s string) string {
+	if s == "" {
+		return "0"
+	}
+	return s
+}
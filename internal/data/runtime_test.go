@@ -0,0 +1,58 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRuntime(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Runtime
+		err   error
+	}{
+		{"102", 102, nil},
+		{"102 mins", 102, nil},
+		{"102 min", 102, nil},
+		{"102mins", 102, nil},
+		{"102 minutes", 102, nil},
+		{"102 MINS", 102, nil},
+		{"  102 mins  ", 102, nil},
+		{"1h 42m", 102, nil},
+		{"1h42m", 102, nil},
+		{"1h 42min", 102, nil},
+		{"1h 42mins", 102, nil},
+		{"1 hr 42 min", 102, nil},
+		{"1 hour 42 minutes", 102, nil},
+		{"2h", 120, nil},
+		{"2 hours", 120, nil},
+		{"42m", 42, nil},
+		{"PT1H42M", 102, nil},
+		{"pt1h42m", 102, nil},
+		{"PT2H", 120, nil},
+		{"PT42M", 42, nil},
+		{"PT101M30S", 102, nil},
+		{"", 0, ErrInvalidRuntimeFormat},
+		{"mins", 0, ErrInvalidRuntimeFormat},
+		{"h", 0, ErrInvalidRuntimeFormat},
+		{"PT", 0, ErrInvalidRuntimeFormat},
+		{"1h 42", 0, ErrInvalidRuntimeFormat},
+		{"-5 mins", 0, ErrInvalidRuntimeFormat},
+		{"1.5 hours", 0, ErrInvalidRuntimeFormat},
+		{"102 seconds", 0, ErrInvalidRuntimeFormat},
+		{"42m 1h", 0, ErrInvalidRuntimeFormat},
+		{"99999999999 mins", 0, ErrInvalidRuntimeFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseRuntime(tt.input)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseRuntime(%q) error = %v, want %v", tt.input, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRuntime(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
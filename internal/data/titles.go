@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"time"
+
+	"github.com/able8/greenlight/internal/validator"
+)
+
+// Declare a regular expression for sanity checking locales, which we store as
+// lower-case BCP 47 language tags like "en", "pt-br" or "zh-hant".
+var (
+	LocaleRX = regexp.MustCompile("^[a-z]{2,3}(-[a-z0-9]{2,8})*$")
+)
+
+// MovieTitle holds the title of a movie in a specific locale. At most one of the
+// titles for a movie can be marked as the original title.
+type MovieTitle struct {
+	MovieID  int64  `json:"-"`
+	Locale   string `json:"locale"`
+	Title    string `json:"title"`
+	Original bool   `json:"original"`
+}
+
+func ValidateMovieTitle(v *validator.Validator, title *MovieTitle) {
+	v.Check(validator.Matches(title.Locale, LocaleRX), "locale", "must be a valid language tag")
+
+	v.Check(title.Title != "", "title", "must be provided")
+	v.Check(len(title.Title) <= 500, "title", "must not be more than 500 bytes long")
+}
+
+// Define a MovieTitleModel struct type which wraps a sql.DB connection pool.
+type MovieTitleModel struct {
+	DB *sql.DB
+}
+
+// GetAllForMovie returns all of the localized titles for a movie, ordered by locale.
+func (m MovieTitleModel) GetAllForMovie(movieID int64) ([]*MovieTitle, error) {
+	query := `
+		SELECT movie_id, locale, title, original
+		FROM movie_titles
+		WHERE movie_id = $1
+		ORDER BY locale
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	titles := []*MovieTitle{}
+
+	for rows.Next() {
+		var title MovieTitle
+
+		err := rows.Scan(&title.MovieID, &title.Locale, &title.Title, &title.Original)
+		if err != nil {
+			return nil, err
+		}
+
+		titles = append(titles, &title)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return titles, nil
+}
+
+// Upsert creates or replaces the title for a movie in a specific locale. If the title
+// is marked as the original, any other original title for the movie is unmarked in
+// the same transaction.
+func (m MovieTitleModel) Upsert(title *MovieTitle) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if title.Original {
+		query := `
+			UPDATE movie_titles
+			SET original = false
+			WHERE movie_id = $1 AND locale <> $2 AND original
+		`
+
+		_, err = tx.ExecContext(ctx, query, title.MovieID, title.Locale)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		INSERT INTO movie_titles (movie_id, locale, title, original)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (movie_id, locale) DO UPDATE
+		SET title = EXCLUDED.title, original = EXCLUDED.original
+	`
+
+	_, err = tx.ExecContext(ctx, query, title.MovieID, title.Locale, title.Title, title.Original)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes the title for a movie in a specific locale.
+func (m MovieTitleModel) Delete(movieID int64, locale string) error {
+	if movieID < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM movie_titles
+		WHERE movie_id = $1 AND locale = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, movieID, locale)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
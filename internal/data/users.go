@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/able8/greenlight/internal/validator"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -270,3 +271,48 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
+
+// GetForCertificateSubjects returns the user mapped to the first of the given client
+// certificate subjects which has a mapping in the client_certificates table. The
+// subjects are checked in order, so the common name can take priority over the
+// subject alternative names.
+func (m UserModel) GetForCertificateSubjects(subjects []string) (*User, error) {
+	if len(subjects) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		FROM users
+		INNER JOIN client_certificates
+		ON users.id = client_certificates.user_id
+		WHERE client_certificates.subject = ANY($1)
+		ORDER BY array_position($1, client_certificates.subject)
+		LIMIT 1
+	`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, pq.Array(subjects)).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,246 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/able8/greenlight/internal/validator"
+)
+
+// Define a custom ErrDuplicateWatchlistItem error, returned when a user tries to add
+// a movie which is already on their watchlist.
+var (
+	ErrDuplicateWatchlistItem = errors.New("duplicate watchlist item")
+)
+
+// WatchlistItem represents a single movie on a user's personal watchlist. The Title
+// and Year fields are read from the movies table so that clients don't need to make
+// a separate request for each movie when displaying the list.
+type WatchlistItem struct {
+	UserID    int64      `json:"-"`
+	MovieID   int64      `json:"movie_id"`
+	Title     string     `json:"title"`
+	Year      int32      `json:"year,omitempty"`
+	AddedAt   time.Time  `json:"added_at"`
+	Position  int32      `json:"position"`
+	Watched   bool       `json:"watched"`
+	WatchedAt *time.Time `json:"watched_at,omitempty"`
+	Version   int32      `json:"version"`
+}
+
+func ValidateWatchlistItem(v *validator.Validator, item *WatchlistItem) {
+	v.Check(item.MovieID > 0, "movie_id", "must be provided")
+
+	// A zero position is only used when inserting, and means "add to the end of the list".
+	v.Check(item.Position >= 0, "position", "must not be negative")
+	v.Check(item.Position <= 1_000_000, "position", "must be a maximum of 1000000")
+
+	if item.WatchedAt != nil {
+		v.Check(item.Watched, "watched_at", "must not be set for an unwatched movie")
+		v.Check(!item.WatchedAt.After(time.Now()), "watched_at", "must not be in the future")
+	}
+}
+
+// Define a WatchlistModel struct type which wraps a sql.DB connection pool.
+type WatchlistModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a movie to a user's watchlist. If the item has a zero Position, the
+// movie is placed after the last item currently on the list.
+func (m WatchlistModel) Insert(item *WatchlistItem) error {
+	query := `
+		INSERT INTO watchlist_items (user_id, movie_id, position, watched, watched_at)
+		VALUES ($1, $2,
+			CASE WHEN $3 > 0 THEN $3 ELSE (
+				SELECT COALESCE(max(position), 0) + 1 FROM watchlist_items WHERE user_id = $1
+			) END,
+			$4, $5)
+		RETURNING added_at, position, version
+	`
+
+	args := []interface{}{item.UserID, item.MovieID, item.Position, item.Watched, item.WatchedAt}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&item.AddedAt, &item.Position, &item.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "watchlist_items_pkey"`:
+			return ErrDuplicateWatchlistItem
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get retrieves a single movie from a user's watchlist.
+func (m WatchlistModel) Get(userID, movieID int64) (*WatchlistItem, error) {
+	if movieID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT watchlist_items.user_id, watchlist_items.movie_id, movies.title, movies.year,
+			watchlist_items.added_at, watchlist_items.position, watchlist_items.watched,
+			watchlist_items.watched_at, watchlist_items.version
+		FROM watchlist_items
+		INNER JOIN movies ON movies.id = watchlist_items.movie_id
+		WHERE watchlist_items.user_id = $1 AND watchlist_items.movie_id = $2
+	`
+
+	var item WatchlistItem
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, movieID).Scan(
+		&item.UserID,
+		&item.MovieID,
+		&item.Title,
+		&item.Year,
+		&item.AddedAt,
+		&item.Position,
+		&item.Watched,
+		&item.WatchedAt,
+		&item.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &item, nil
+}
+
+// GetAllForUser returns a page of the user's watchlist, sorted according to the filters.
+func (m WatchlistModel) GetAllForUser(userID int64, filters Filters) ([]*WatchlistItem, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), watchlist_items.user_id, watchlist_items.movie_id, movies.title, movies.year,
+			watchlist_items.added_at, watchlist_items.position, watchlist_items.watched,
+			watchlist_items.watched_at, watchlist_items.version
+		FROM watchlist_items
+		INNER JOIN movies ON movies.id = watchlist_items.movie_id
+		WHERE watchlist_items.user_id = $1
+		ORDER BY %s %s, movie_id ASC
+		LIMIT $2 OFFSET $3
+	`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	items := []*WatchlistItem{}
+
+	for rows.Next() {
+		var item WatchlistItem
+
+		err := rows.Scan(
+			&totalRecords,
+			&item.UserID,
+			&item.MovieID,
+			&item.Title,
+			&item.Year,
+			&item.AddedAt,
+			&item.Position,
+			&item.Watched,
+			&item.WatchedAt,
+			&item.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return items, metadata, nil
+}
+
+// Update the position and watched status of a watchlist item, checking against the
+// version number to prevent race conditions.
+func (m WatchlistModel) Update(item *WatchlistItem) error {
+	query := `
+		UPDATE watchlist_items
+		SET position = $1, watched = $2, watched_at = $3, version = version + 1
+		WHERE user_id = $4 AND movie_id = $5 AND version = $6
+		RETURNING version
+	`
+
+	args := []interface{}{
+		item.Position,
+		item.Watched,
+		item.WatchedAt,
+		item.UserID,
+		item.MovieID,
+		item.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&item.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a movie from a user's watchlist.
+func (m WatchlistModel) Delete(userID, movieID int64) error {
+	if movieID < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM watchlist_items
+		WHERE user_id = $1 AND movie_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -2,9 +2,14 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,79 +19,246 @@ type Level int8
 // Initialize constants whic represent a specific severity level.
 // We use the iota keyword as a shortcut to assign sucessive integer values to the constants.
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota // Has the value 0.
+	LevelInfo               // Has the value 1.
+	LevelWarn               // Has the value 2.
+	LevelError              // Has the value 3.
+	LevelFatal              // Has the value 4.
+	LevelOff                // Has the value 5.
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel returns the Level for a name like "debug" or "WARN". The name is not
+// case-sensitive.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// ParseLevels parses a whitespace-separated list of level names, like "error fatal".
+func ParseLevels(s string) ([]Level, error) {
+	var levels []Level
+
+	for _, name := range strings.Fields(s) {
+		level, err := ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+
+	return levels, nil
+}
+
+// Properties holds the additional properties for a log entry. Values are written as
+// JSON, so numbers and booleans keep their type. Errors and time.Duration values are
+// written as strings, as they would otherwise be encoded as {} and as a number of
+// nanoseconds respectively.
+type Properties map[string]interface{}
+
 // Define a custom Logger type. This holds the ouput destination that the log entries
 // will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// plus a mutex for coordinating the writes. It also holds a bitmask of the levels
+// which have a stack trace captured. These are shared with any child loggers created
+// by the With() method, which also hold a set of bound properties.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	out         io.Writer
+	minLevel    *int32
+	traceLevels *uint32
+	mu          *sync.Mutex
+	fields      Properties
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum
 // severity level to a specific output destination.
 func New(out io.Writer, minLevel Level) *Logger {
+	level := int32(minLevel)
+
+	// By default, stack traces are captured for ERROR and FATAL entries.
+	traceLevels := uint32(1<<LevelError | 1<<LevelFatal)
+
+	return &Logger{
+		out:         out,
+		minLevel:    &level,
+		traceLevels: &traceLevels,
+		mu:          &sync.Mutex{},
+	}
+}
+
+// With returns a child logger which includes the given properties in every log entry,
+// in addition to any properties bound to the parent. The child shares its output
+// destination and minimum level with the parent.
+func (l *Logger) With(properties Properties) *Logger {
+	fields := make(Properties, len(l.fields)+len(properties))
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	for k, v := range properties {
+		fields[k] = v
+	}
+
 	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+		out:         l.out,
+		minLevel:    l.minLevel,
+		traceLevels: l.traceLevels,
+		mu:          l.mu,
+		fields:      fields,
+	}
+}
+
+// Level returns the current minimum severity level.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(l.minLevel))
+}
+
+// SetLevel changes the minimum severity level for the logger and all of the loggers
+// that share it. It is safe to call while other goroutines are writing log entries.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(l.minLevel, int32(level))
+}
+
+// SetTraceLevels sets the levels for which a stack trace is captured and included in
+// the log entry. Calling it with no levels turns stack traces off, except for panics.
+func (l *Logger) SetTraceLevels(levels ...Level) {
+	var mask uint32
+	for _, level := range levels {
+		mask |= 1 << level
 	}
+	atomic.StoreUint32(l.traceLevels, mask)
 }
 
 // Declare some helper methods for writing log entries at the different levels.
 // Notice that these all accept a map as the second parameter which can contain any
 // arbitrary properties that you want to appear in the log entry.
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+func (l *Logger) PrintDebug(message string, properties Properties) {
+	l.print(LevelDebug, message, nil, properties)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+func (l *Logger) PrintInfo(message string, properties Properties) {
+	l.print(LevelInfo, message, nil, properties)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	l.print(LevelFatal, err.Error(), properties)
+func (l *Logger) PrintWarn(message string, properties Properties) {
+	l.print(LevelWarn, message, nil, properties)
+}
+
+func (l *Logger) PrintError(err error, properties Properties) {
+	l.print(LevelError, err.Error(), err, properties)
+}
+
+func (l *Logger) PrintFatal(err error, properties Properties) {
+	l.print(LevelFatal, err.Error(), err, properties)
 	// For entries at the FATAL level, we also terminate the application.
 	os.Exit(1)
 }
 
+// The PanicError type wraps a value recovered from a panic, along with the stack trace
+// of the goroutine which panicked. The stack trace is always included when a
+// PanicError is logged, regardless of the levels set with SetTraceLevels().
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// NewPanicError returns a PanicError for a recovered value. It must be called from the
+// deferred function which called recover(), so that the stack trace includes the
+// point where the panic happened.
+func NewPanicError(value interface{}) *PanicError {
+	return &PanicError{Value: value, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the recovered value if it is an error, such as a runtime.Error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// The cause type describes one error in a chain of wrapped errors.
+type cause struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// causes returns the errors wrapped by err, outermost first.
+func causes(err error) []cause {
+	var list []cause
+	for err = errors.Unwrap(err); err != nil; err = errors.Unwrap(err) {
+		list = append(list, cause{Type: fmt.Sprintf("%T", err), Message: err.Error()})
+	}
+	return list
+}
+
 // print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
+func (l *Logger) print(level Level, message string, err error, properties Properties) (int, error) {
+	if level < l.Level() {
 		return 0, nil
 	}
 
+	// Merge the bound properties with the properties for this entry, converting any
+	// values which don't encode sensibly as JSON.
+	var merged Properties
+	if len(l.fields)+len(properties) > 0 {
+		merged = make(Properties, len(l.fields)+len(properties))
+		for k, v := range l.fields {
+			merged[k] = encodable(v)
+		}
+		for k, v := range properties {
+			merged[k] = encodable(v)
+		}
+	}
+
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string     `json:"level"`
+		Time       string     `json:"time"`
+		Message    string     `json:"message"`
+		Properties Properties `json:"properties,omitempty"`
+		Causes     []cause    `json:"causes,omitempty"`
+		Trace      string     `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: merged,
+		Causes:     causes(err),
+	}
+
+	// Include the stack trace from a panic if there is one. Otherwise, capture the
+	// stack trace of the current goroutine if it is turned on for this level.
+	var panicErr *PanicError
+	switch {
+	case errors.As(err, &panicErr):
+		aux.Trace = string(panicErr.Stack)
+	case atomic.LoadUint32(l.traceLevels)&(1<<level) != 0:
+		aux.Trace = string(debug.Stack())
 	}
 
 	// Declare a line variable for holding the actual log entry text.
@@ -95,9 +267,9 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	// Marshal the anonymous struct to JSON and store it in the line variable.
 	// If there was a problem creating the JSON, set the contents of the log entry
 	// to be that plain-text error message instead.
-	line, err := json.Marshal(aux)
-	if err != nil {
-		line = []byte(LevelError.String() + ": unable to marshal log message" + err.Error())
+	line, marshalErr := json.Marshal(aux)
+	if marshalErr != nil {
+		line = []byte(LevelError.String() + ": unable to marshal log message" + marshalErr.Error())
 	}
 
 	// Lock the mutex so that no two writes to the output destination cannot happen
@@ -110,9 +282,21 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	return l.out.Write(append(line, '\n'))
 }
 
+// encodable converts property values which json.Marshal() would encode unhelpfully.
+func encodable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	default:
+		return v
+	}
+}
+
 // We also implement a Write() method on our Logger type so that
 // it satisfies the io.Writer interface. This writes a log entry at
 // the ERROR level with no additional properties.
 func (l *Logger) Write(message []byte) (n int, err error) {
-	return l.print(LevelInfo, string(message), nil)
+	return l.print(LevelInfo, string(message), nil, nil)
 }
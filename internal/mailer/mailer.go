@@ -37,6 +37,16 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
+// Check connects and authenticates to the SMTP server without sending a message, to
+// make sure that emails can be sent.
+func (m Mailer) Check() error {
+	sender, err := m.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	return sender.Close()
+}
+
 func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	// Use the ParseFS() method to parse the required template file from the embeded file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
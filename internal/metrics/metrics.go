@@ -0,0 +1,332 @@
+// Package metrics implements the small subset of the Prometheus client that we need:
+// counters and histograms with labels, gauges and counters whose values are read from
+// a function, and a handler which writes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the histogram buckets used for
+// request latencies if no others are configured. They are the same as the defaults in
+// the official Prometheus client.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A collector writes the samples for one metric family.
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics, and writes them out in the order that they were
+// registered.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.collectors = append(reg.collectors, c)
+}
+
+// Write writes all of the registered metrics to w in the text exposition format.
+func (reg *Registry) Write(w io.Writer) error {
+	reg.mu.Lock()
+	collectors := make([]collector, len(reg.collectors))
+	copy(collectors, reg.collectors)
+	reg.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns a http.Handler which serves the registered metrics.
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reg.Write(w)
+	})
+}
+
+// CounterVec is a counter which is partitioned by a set of labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec registers a new counter with the given label names.
+func (reg *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	reg.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values by 1. The values must be
+// given in the same order as the label names.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the given label values.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := seriesKey(c.labels, labelValues)
+
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Snapshot returns the current value of the counter for each combination of label
+// values. The map keys are the label values joined by spaces, like "GET 200".
+func (c *CounterVec) Snapshot() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := make(map[string]float64, len(c.values))
+	for key, v := range c.values {
+		snapshot[strings.Join(splitKey(key), " ")] = v
+	}
+
+	return snapshot
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, c.name, c.labels, splitKey(key), "", "", c.values[key])
+	}
+}
+
+// HistogramVec is a histogram which is partitioned by a set of labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Non-cumulative counts for each bucket.
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a new histogram with the given bucket upper bounds and
+// label names. The buckets must be sorted in increasing order, and a +Inf bucket is
+// always added.
+func (reg *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	reg.register(h)
+	return h
+}
+
+// Observe adds a single observation to the histogram for the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := seriesKey(h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	// Find the first bucket with an upper bound which is at least v. Observations
+	// above the largest bound are only counted in the +Inf bucket.
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// HistogramSnapshot holds the state of a single histogram. Like in the text format,
+// the bucket counts are cumulative and keyed by their upper bound.
+type HistogramSnapshot struct {
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+// Snapshot returns the current state of the histogram for each combination of label
+// values. The map keys are the label values joined by spaces, like "GET /v1/movies".
+func (h *HistogramVec) Snapshot() map[string]HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := make(map[string]HistogramSnapshot, len(h.series))
+	for key, s := range h.series {
+		buckets := make(map[string]uint64, len(h.buckets)+1)
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			buckets[formatFloat(bound)] = cumulative
+		}
+		buckets["+Inf"] = s.count
+
+		snapshot[strings.Join(splitKey(key), " ")] = HistogramSnapshot{Count: s.count, Sum: s.sum, Buckets: buckets}
+	}
+
+	return snapshot
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		values := splitKey(key)
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, values, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, values, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, values, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, values, "", "", float64(s.count))
+	}
+}
+
+// funcMetric is a gauge or counter without labels, whose value is read from a function
+// each time the metrics are written.
+type funcMetric struct {
+	name string
+	help string
+	typ  string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is the result of calling fn.
+func (reg *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	reg.register(&funcMetric{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// NewCounterFunc registers a counter whose value is the result of calling fn. The
+// function must return a value which never decreases.
+func (reg *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	reg.register(&funcMetric{name: name, help: help, typ: "counter", fn: fn})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.typ)
+	writeSample(w, f.name, nil, nil, "", "", f.fn())
+}
+
+// seriesKey joins label values into a single map key. It panics if the number of
+// values doesn't match the number of labels, as that is always a programming error.
+func seriesKey(labels, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("metrics: expected %d label values, got %d", len(labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func splitKey(key string) []string {
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writeSample writes one sample line. The extra label (if any) is appended after the
+// regular labels, which is how the "le" label of histogram buckets is written.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, label, values[i])
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabel(w *bufio.Writer, label, value string) {
+	w.WriteString(label)
+	w.WriteString(`="`)
+	w.WriteString(labelValueEscaper.Replace(value))
+	w.WriteByte('"')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
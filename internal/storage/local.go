@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local is a Storage backend which keeps files in a directory on the local filesystem.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a Local storage backend rooted at the given directory, creating
+// the directory if it doesn't already exist.
+func NewLocal(root string) (*Local, error) {
+	err := os.MkdirAll(root, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{root: root}, nil
+}
+
+// filename converts a key into a path within the root directory. Keys which would
+// escape the root directory (for example by using "..") are rejected.
+func (l *Local) filename(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (l *Local) Put(key string, r io.Reader) error {
+	filename, err := l.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0o750)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file in the same directory first and then rename it into
+	// place, so that readers never see a partially written file.
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+func (l *Local) Open(key string) (io.ReadSeekCloser, error) {
+	filename, err := l.filename(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(key string) error {
+	filename, err := l.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// Define an error that storage backends return when no file exists for a key.
+var ErrNotFound = errors.New("file not found")
+
+// Storage is the interface that file storage backends implement. Keys are
+// slash-separated paths like "movies/1/poster/small.jpg", which each backend maps
+// onto its own naming scheme.
+type Storage interface {
+	// Put stores the contents of r under the given key, replacing any existing file.
+	Put(key string, r io.Reader) error
+
+	// Open returns the file stored under the given key, or ErrNotFound.
+	Open(key string) (io.ReadSeekCloser, error)
+
+	// Delete removes the file stored under the given key. Deleting a key which
+	// doesn't exist is not an error.
+	Delete(key string) error
+}
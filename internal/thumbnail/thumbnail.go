@@ -0,0 +1,121 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+)
+
+// MaxPixels is the largest number of pixels (width times height) that Decode() will
+// decode. A decoded image takes 4 bytes per pixel, and converting it to RGBA for
+// resizing takes the same again, so this keeps the memory needed below about 200MB.
+const MaxPixels = 24000000
+
+// ErrTooLarge is returned by Decode() for images with more than MaxPixels pixels.
+var ErrTooLarge = errors.New("image is too large")
+
+// Decode decodes an image, after checking its dimensions with image.DecodeConfig(), so
+// that we don't allocate a huge amount of memory for a small but maliciously crafted
+// file.
+func Decode(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// Source holds an image which has been converted to RGBA, so that we can work directly
+// with its pixel slice rather than calling At() for every pixel. The conversion is only
+// done once, however many thumbnails are made from the same Source.
+type Source struct {
+	src  image.Image
+	rgba *image.RGBA
+}
+
+// NewSource converts the image to RGBA, unless it already is.
+func NewSource(src image.Image) *Source {
+	bounds := src.Bounds()
+
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+
+	return &Source{src: src, rgba: rgba}
+}
+
+// Resize scales the source image down to the given width, keeping its aspect ratio.
+// It is a shortcut for NewSource(src).Resize(width), for when only one size is needed.
+func Resize(src image.Image, width int) image.Image {
+	if width <= 0 || src.Bounds().Dx() <= width {
+		return src
+	}
+
+	return NewSource(src).Resize(width)
+}
+
+// Resize scales the image down to the given width, keeping its aspect ratio. Each
+// destination pixel is the average of the source pixels that it covers, which gives
+// good results for the downscaling we need without any external dependencies. Images
+// which are already no wider than the given width are returned unchanged.
+func (s *Source) Resize(width int) image.Image {
+	rgba := s.rgba
+	srcW, srcH := rgba.Rect.Dx(), rgba.Rect.Dy()
+
+	if width <= 0 || srcW <= width {
+		return s.src
+	}
+
+	height := srcH * width / srcW
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := (y + 1) * srcH / height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := (x + 1) * srcW / width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(rgba.Pix[i])
+					g += uint32(rgba.Pix[i+1])
+					b += uint32(rgba.Pix[i+2])
+					a += uint32(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS reviews (
+        id bigserial PRIMARY KEY,
+        created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+        movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+        user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+        rating integer NOT NULL,
+        body text NOT NULL DEFAULT '',
+        version integer NOT NULL DEFAULT 1,
+        UNIQUE (movie_id, user_id)
+);
+
+ALTER TABLE reviews ADD CONSTRAINT reviews_rating_check CHECK (rating BETWEEN 1 AND 10);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS watchlist_items (
+        user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+        movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+        added_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+        position integer NOT NULL,
+        watched bool NOT NULL DEFAULT false,
+        watched_at timestamp(0) with time zone,
+        version integer NOT NULL DEFAULT 1,
+        PRIMARY KEY (user_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS watchlist_items_user_position_idx ON watchlist_items (user_id, position);
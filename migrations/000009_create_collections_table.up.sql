@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS collections (
+        id bigserial PRIMARY KEY,
+        created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+        owner_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+        title text NOT NULL,
+        description text NOT NULL DEFAULT '',
+        public bool NOT NULL DEFAULT false,
+        version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS collections_owner_id_idx ON collections (owner_id);
+
+-- The movies in each collection are stored in a join table, in the same way as
+-- users_permissions, so that deleting a movie also removes it from any collections.
+-- The position column holds the order of the movies within the collection.
+CREATE TABLE IF NOT EXISTS collections_movies (
+        collection_id bigint NOT NULL REFERENCES collections ON DELETE CASCADE,
+        movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+        position integer NOT NULL,
+        PRIMARY KEY (collection_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS collections_movies_movie_id_idx ON collections_movies (movie_id);
+
+INSERT INTO permissions (code)
+VALUES
+        ('collections:write');
@@ -0,0 +1,13 @@
+-- Map the genres of movies back from slugs to free text, using the genre names (so
+-- 'science-fiction' becomes 'Science Fiction'). This can't restore the exact text the
+-- genres had before the up migration, as aliases like 'sci-fi' were merged into their
+-- canonical genre, but no genres are lost. Any slug without a genre is kept as is.
+UPDATE movies SET genres = ARRAY(
+        SELECT coalesce(genres.name, g.value)
+        FROM unnest(movies.genres) WITH ORDINALITY AS g (value, position)
+        LEFT JOIN genres ON genres.slug = g.value
+        ORDER BY g.position
+);
+
+DROP TABLE IF EXISTS genre_aliases;
+DROP TABLE IF EXISTS genres;
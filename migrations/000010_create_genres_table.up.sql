@@ -0,0 +1,83 @@
+CREATE TABLE IF NOT EXISTS genres (
+        id bigserial PRIMARY KEY,
+        slug text UNIQUE NOT NULL,
+        name text NOT NULL
+);
+
+-- Aliases are stored in the same normalized form as slugs: lower case, with any run
+-- of non-alphanumeric characters replaced by a single hyphen. Every genre's own slug
+-- is also stored as an alias, so lookups only need to check this table.
+CREATE TABLE IF NOT EXISTS genre_aliases (
+        alias text PRIMARY KEY,
+        genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE
+);
+
+INSERT INTO genres (slug, name)
+VALUES
+        ('action', 'Action'),
+        ('adventure', 'Adventure'),
+        ('animation', 'Animation'),
+        ('biography', 'Biography'),
+        ('comedy', 'Comedy'),
+        ('crime', 'Crime'),
+        ('documentary', 'Documentary'),
+        ('drama', 'Drama'),
+        ('family', 'Family'),
+        ('fantasy', 'Fantasy'),
+        ('history', 'History'),
+        ('horror', 'Horror'),
+        ('music', 'Music'),
+        ('musical', 'Musical'),
+        ('mystery', 'Mystery'),
+        ('romance', 'Romance'),
+        ('science-fiction', 'Science Fiction'),
+        ('sport', 'Sport'),
+        ('thriller', 'Thriller'),
+        ('war', 'War'),
+        ('western', 'Western');
+
+INSERT INTO genre_aliases (alias, genre_id)
+SELECT slug, id FROM genres;
+
+INSERT INTO genre_aliases (alias, genre_id)
+SELECT aliases.alias, genres.id
+FROM (
+        VALUES
+                ('sci-fi', 'science-fiction'),
+                ('scifi', 'science-fiction'),
+                ('sf', 'science-fiction'),
+                ('animated', 'animation'),
+                ('anime', 'animation'),
+                ('doc', 'documentary'),
+                ('documentaries', 'documentary'),
+                ('historical', 'history'),
+                ('biopic', 'biography'),
+                ('sports', 'sport'),
+                ('romantic', 'romance'),
+                ('comedies', 'comedy'),
+                ('thrillers', 'thriller'),
+                ('westerns', 'western')
+) AS aliases (alias, slug)
+INNER JOIN genres ON genres.slug = aliases.slug;
+
+-- Any existing genre values which don't match a known alias become genres in their own right.
+INSERT INTO genres (slug, name)
+SELECT DISTINCT trim(both '-' from regexp_replace(lower(value), '[^a-z0-9]+', '-', 'g')), initcap(trim(value))
+FROM movies, unnest(movies.genres) AS value
+WHERE trim(both '-' from regexp_replace(lower(value), '[^a-z0-9]+', '-', 'g')) NOT IN (SELECT alias FROM genre_aliases)
+ON CONFLICT (slug) DO NOTHING;
+
+INSERT INTO genre_aliases (alias, genre_id)
+SELECT slug, id FROM genres
+ON CONFLICT (alias) DO NOTHING;
+
+-- Rewrite the genres of existing movies onto the canonical slugs, keeping their
+-- original order and dropping any duplicates created by the mapping.
+UPDATE movies SET genres = ARRAY(
+        SELECT genres.slug
+        FROM unnest(movies.genres) WITH ORDINALITY AS g (value, position)
+        INNER JOIN genre_aliases ON genre_aliases.alias = trim(both '-' from regexp_replace(lower(g.value), '[^a-z0-9]+', '-', 'g'))
+        INNER JOIN genres ON genres.id = genre_aliases.genre_id
+        GROUP BY genres.slug
+        ORDER BY min(g.position)
+);
@@ -0,0 +1 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS poster_updated_at timestamp(0) with time zone;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS movie_titles (
+        movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+        locale text NOT NULL,
+        title text NOT NULL,
+        original bool NOT NULL DEFAULT false,
+        PRIMARY KEY (movie_id, locale)
+);
+
+-- Each movie can have at most one original title.
+CREATE UNIQUE INDEX IF NOT EXISTS movie_titles_original_idx ON movie_titles (movie_id) WHERE original;
+
+CREATE INDEX IF NOT EXISTS movie_titles_title_idx ON movie_titles USING GIN (to_tsvector('simple', title));
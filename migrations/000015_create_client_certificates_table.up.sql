@@ -0,0 +1,10 @@
+-- Maps the subjects (common names and subject alternative names) of client
+-- certificates to the users that they authenticate as. Service users are ordinary
+-- activated users, and their permissions are granted in users_permissions as usual.
+CREATE TABLE IF NOT EXISTS client_certificates (
+        subject text PRIMARY KEY,
+        user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+        created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS client_certificates_user_id_idx ON client_certificates (user_id);
@@ -0,0 +1,37 @@
+// Package migrations embeds the SQL migration files, so that the API binary can apply
+// them without the migrations directory being deployed alongside it.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4/source"
+)
+
+// FS holds the up and down SQL files for each migration.
+//
+//go:embed *.sql
+var FS embed.FS
+
+// LatestVersion returns the version of the newest migration, which is the schema
+// version that the binary expects the database to be at.
+func LatestVersion() (uint, error) {
+	entries, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest uint
+	for _, entry := range entries {
+		m, err := source.Parse(entry.Name())
+		if err != nil {
+			continue
+		}
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+
+	return latest, nil
+}